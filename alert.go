@@ -0,0 +1,26 @@
+package main
+
+// checkAlerts warns about each zone whose free blocks at the alert order are
+// at or below the threshold, the usual early sign that high-order
+// allocations are about to fail. With AlertField, it also records the result
+// as an alert field on the entry.
+func checkAlerts(batch []BuddyEntry, influx InfluxSettings) {
+	for _, entry := range batch {
+		if influx.AlertOrder >= len(entry.Orders) {
+			continue
+		}
+		free := entry.Orders[influx.AlertOrder]
+		low := free <= influx.AlertThreshold
+		if low {
+			logger.Warnf("Node %s zone %s has %d free order-%d blocks (threshold %d)",
+				entry.Node, entry.Zone, free, influx.AlertOrder, influx.AlertThreshold)
+		}
+		if influx.AlertField {
+			if low {
+				entry.Pages[influx.FieldPrefix+"alert"] = int64(1)
+			} else {
+				entry.Pages[influx.FieldPrefix+"alert"] = int64(0)
+			}
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCheckAlerts(t *testing.T) {
+	lines := []string{
+		"Node 0, zone      DMA      1      1      1      0      2      1      1      0      1      1      3",
+		"Node 0, zone    DMA32      3      6      5      3      3      4      2      4      3      1    270",
+		"Node 0, zone   Normal  23821   5715     90     16      8      4      9      2      0      0      0",
+		"Node 1, zone   Normal   3888  10304    405    139     50     59     38     19      4      2      9",
+	}
+	tests := []struct {
+		order     int
+		threshold int64
+		alerts    []int64 // alert field for each line
+	}{
+		{10, 0, []int64{0, 0, 1, 0}},
+		{10, 5, []int64{1, 0, 1, 0}},
+		{10, 9, []int64{1, 0, 1, 1}},
+		{0, 100, []int64{1, 1, 0, 0}},
+		{8, 0, []int64{0, 0, 1, 0}},
+	}
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	for _, tt := range tests {
+		influx := testSettings()
+		influx.AlertOrder = tt.order
+		influx.AlertThreshold = tt.threshold
+		influx.AlertField = true
+		var batch []BuddyEntry
+		for _, line := range lines {
+			entry, err := makeBuddyEntry(line, influx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			batch = append(batch, entry)
+		}
+
+		logged.Reset()
+		checkAlerts(batch, influx)
+		var alerts []int64
+		for _, entry := range batch {
+			alerts = append(alerts, entry.Pages["alert"].(int64))
+		}
+		if !reflect.DeepEqual(alerts, tt.alerts) {
+			t.Errorf("order %d threshold %d: alerts %v, want %v", tt.order, tt.threshold, alerts, tt.alerts)
+		}
+
+		var warned []int64
+		for _, entry := range batch {
+			warning := "WARNING: Node " + entry.Node + " zone " + entry.Zone + " has "
+			if strings.Contains(logged.String(), warning) {
+				warned = append(warned, 1)
+			} else {
+				warned = append(warned, 0)
+			}
+		}
+		if !reflect.DeepEqual(warned, tt.alerts) {
+			t.Errorf("order %d threshold %d: warned %v, want %v in:\n%s", tt.order, tt.threshold, warned, tt.alerts, logged.String())
+		}
+	}
+}
@@ -2,109 +2,769 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/influxdata/influxdb/client/v2"
 )
 
-const buddyPath = "/proc/buddyinfo"
-const assertFieldCount = 15 // requisite fields in each buddyinfo line
+const defaultBuddyPath = "/proc/buddyinfo"
+
+// Minimum fields in each buddyinfo line: "Node", node number, "zone", zone
+// name, then one count per page order. The number of orders depends on the
+// kernel's MAX_ORDER, which varies by architecture and configuration. Some
+// kernels omit the node, so the "Node N," prefix is optional.
+const minFieldCount = 3
+
+// gzipMagic is the header that starts every gzip stream.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// knownZones lists the memory zone names the kernel reports in buddyinfo.
+var knownZones = map[string]bool{
+	"DMA":     true,
+	"DMA32":   true,
+	"Normal":  true,
+	"HighMem": true,
+	"Movable": true,
+	"Device":  true,
+}
+
+// smallZones are the low-memory zones dropped by --skip-small-zones. On
+// 64-bit machines they're tiny and rarely interesting.
+var smallZones = map[string]bool{
+	"DMA":   true,
+	"DMA32": true,
+}
+
+// Build information, set at link time, e.g.
+// go build -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse HEAD)"
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
 
 var influxConfig InfluxSettings
 
+// parseErrors counts buddyinfo lines skipped because they failed to parse.
+var parseErrors uint64
+
+// maxPageOrder is the highest page order any kernel configuration allows
+// (MAX_PAGE_ORDER tops out well below it on every architecture), which bounds
+// the order flags so the block size arithmetic can't overflow.
+const maxPageOrder = 20
+
+// orderCount is the number of page orders in buddyinfo lines, which is the
+// kernel's MAX_ORDER (MAX_PAGE_ORDER+1 on newer kernels), or 0 until known.
+var orderCount int
+
 func init() {
-	influxConfig = getConfig()
+	rand.Seed(time.Now().UnixNano())
 }
 
 // BuddyEntry binds a set of page entries to node number and zone.
 type BuddyEntry struct {
-	Pages map[string]interface{} // Matches fields arg of InfluxDB data point.
-	Node  string
-	Zone  string
+	Pages  map[string]interface{} // Matches fields arg of InfluxDB data point.
+	Node   string
+	Zone   string
+	Orders []int64 // Free block counts indexed by page order
+
+	// Measurement overrides the configured measurement name. It is set by
+	// companion collectors, such as zoneinfo, that write alongside buddyinfo.
+	Measurement string `json:",omitempty"`
+
+	// Tags are extra tags for this entry, such as pagetypeinfo's migrate type.
+	Tags map[string]string `json:",omitempty"`
 }
 
 func main() {
+	influxConfig = getConfig()
+	conns := newInfluxConns(influxConfig)
+
+	if influxConfig.PrecisionTest {
+		checkClock()
+	}
+	if influxConfig.writesInflux() {
+		if err := connectInflux(conns); err != nil && influxConfig.RequireInflux {
+			logger.Errorf("%v", err)
+			os.Exit(1)
+		}
+	}
+
+	// Cancel on SIGINT or SIGTERM, which abandons any write in progress.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		logger.Infof("Received %v, shutting down", sig)
+		cancel()
+	}()
+
+	if influxConfig.ReplayDir != "" {
+		err := replaySnapshots(ctx, conns, influxConfig.ReplayDir)
+		conns.Close()
+		if err != nil {
+			logger.Errorf("%v", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if influxConfig.OneShot {
+		n, err := processBuddyInfo(ctx, conns, influxConfig, influxConfig.Path)
+		conns.Close()
+		if err != nil {
+			logger.Errorf("%v", err)
+			os.Exit(1)
+		}
+		logger.Debugf("Wrote %d points", n)
+		return
+	}
+	defer conns.Close()
+
+	// Reloads only change settings used by the poll loop, so the rest can
+	// be read from a copy taken before they start.
+	influx := influxConfig
+	watchConfig(conns)
+
+	if influx.Listen != "" {
+		go servePrometheus(influx.Listen)
+	}
+	if influx.HealthAddr != "" {
+		go serveHealth(influx.HealthAddr)
+	}
+	if influx.DebugAddr != "" {
+		go serveDebug(influx.DebugAddr)
+	}
+
+	// SIGUSR1 polls immediately, e.g. to capture the moment an allocation
+	// fails, without disturbing the regular schedule.
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	go func() {
+		for range usr1 {
+			logger.Infof("Received SIGUSR1, polling now")
+			poll(ctx, conns)
+		}
+	}()
+
+	if influxConfig.WatchFile {
+		err := watchFile(ctx, conns, influxConfig.Path)
+		if err == nil {
+			return
+		}
+		logger.Warnf("Can't watch %s, polling instead: %v", influxConfig.Path, err)
+	}
+
 	for {
-		if err := processBuddyInfo(); err != nil {
-			log.Println("ERROR:", err)
+		poll(ctx, conns)
+
+		configMu.RLock()
+		interval := influxConfig.Interval + jitter(influxConfig.Jitter)
+		configMu.RUnlock()
+
+		select {
+		case <-clk.After(interval):
+		case <-ctx.Done():
+			return
 		}
-		time.Sleep(influxConfig.Interval)
 	}
 }
 
-func processBuddyInfo() error {
-	lines, err := slurpLines(buddyPath)
+// pollMu keeps an on-demand poll from overlapping a scheduled one.
+var pollMu sync.Mutex
+
+// poll runs one collection cycle and records its outcome.
+func poll(ctx context.Context, conns influxConns) {
+	pollMu.Lock()
+	defer pollMu.Unlock()
+
+	// Work from a copy, so a config reload doesn't wait for a slow write.
+	configMu.RLock()
+	influx := influxConfig
+	configMu.RUnlock()
+
+	n, err := processBuddyInfo(ctx, conns, influx, influx.Path)
 	if err != nil {
-		return err
+		logger.Errorf("%v", err)
+	} else {
+		logger.Debugf("Wrote %d points", n)
+	}
+	if ctx.Err() == nil {
+		cycleHealth.record(err)
+	}
+}
+
+func processBuddyInfo(ctx context.Context, conns influxConns, influx InfluxSettings, path string) (int, error) {
+	atomic.AddUint64(&pollCount, 1)
+
+	// Stamp every point with the time the poll started, captured once, so a
+	// slow read doesn't skew it and spooled batches replay with their
+	// original time, overwriting rather than duplicating points.
+	t := clk.Now()
+	batch, err := parseBuddyInfo(path, influx)
+	if err != nil {
+		return 0, err
+	}
+	if influx.EmitDeltas {
+		addDeltas(batch, influx)
+	}
+	if influx.AlertOrder >= 0 {
+		checkAlerts(batch, influx)
+	}
+	if influx.DebugAddr != "" {
+		lastRead.setParsed(batch)
+	}
+
+	// Companion collectors are written with buddyinfo, but the Prometheus
+	// exporter only serves buddyinfo.
+	if influx.CollectZoneinfo && influx.Listen == "" {
+		zones, err := parseZoneInfo(influx.ZoneinfoPath, influx.ZoneinfoMeasurement, influx)
+		if err != nil {
+			return 0, err
+		}
+		batch = append(batch, zones...)
+	}
+	if influx.CollectPagetypeinfo && influx.Listen == "" {
+		types, err := parsePagetypeInfo(influx.PagetypeinfoPath, influx.PagetypeinfoMeasurement, influx)
+		if err != nil {
+			return 0, err
+		}
+		batch = append(batch, types...)
+	}
+	if influx.CollectMeminfo && influx.Listen == "" {
+		mem, err := parseMemInfo(influx.MeminfoPath, influx.MeminfoMeasurement, influx)
+		if err != nil {
+			return 0, err
+		}
+		batch = append(batch, mem)
+	}
+	if influx.SelfMetrics && influx.Listen == "" {
+		batch = append(batch, internalEntry())
+	}
+
+	// With --only-on-change, only write series that changed, and remember
+	// them once written.
+	if influx.OnlyOnChange && influx.Listen == "" {
+		batch = lastSeen.changed(batch, t, influx.MaxStale)
+	}
+	n, err := emitBatch(ctx, conns, influx, batch, t)
+	if err != nil {
+		atomic.AddUint64(&writeErrors, 1)
+		return 0, err
+	}
+	if influx.OnlyOnChange {
+		lastSeen.record(batch, t)
+	}
+	return n, nil
+}
+
+// parseBuddyInfo reads a buddyinfo file and returns an entry for each line.
+func parseBuddyInfo(path string, influx InfluxSettings) ([]BuddyEntry, error) {
+	lines, err := slurpLines(path, influx)
+	if err != nil {
+		return nil, err
+	}
+	if influx.DebugAddr != "" {
+		lastRead.setRaw(lines)
 	}
 
+	// Skip lines that fail to parse so one odd line doesn't lose every zone,
+	// unless strict parsing was requested.
 	var batch []BuddyEntry
-	for _, line := range lines {
-		entry, err := makeBuddyEntry(line)
+	var bad uint64
+	for i, line := range lines {
+		if strings.TrimSpace(strings.TrimPrefix(line, "\ufeff")) == "" {
+			continue
+		}
+		entry, err := makeBuddyEntry(line, influx)
 		if err != nil {
-			return err
+			if influx.Strict {
+				return nil, err
+			}
+			logger.Warnf("skipping line: %v", err)
+			bad++
+			continue
+		}
+		if influx.SampleLines <= 0 || i < influx.SampleLines {
+			logger.Debugf("Parsed node=%s zone=%s fields=%v", entry.Node, entry.Zone, entry.Pages)
+		}
+		if !allowed(influx.Nodes, entry.Node) || !zoneAllowed(influx, entry.Zone) {
+			continue
+		}
+		if len(influx.Fields) > 0 {
+			for name := range entry.Pages {
+				// --fields names fields without the prefix.
+				if !allowed(influx.Fields, strings.TrimPrefix(name, influx.FieldPrefix)) {
+					delete(entry.Pages, name)
+				}
+			}
+			if len(entry.Pages) == 0 {
+				continue
+			}
 		}
 		batch = append(batch, entry)
 	}
-	return updateInflux(influxConfig, batch)
+
+	if bad > 0 {
+		atomic.AddUint64(&parseErrors, bad)
+		logger.Warnf("%d of %d lines in %s failed to parse", bad, len(lines), path)
+	}
+	if len(batch) > 0 {
+		checkOrderCount(len(batch[0].Orders))
+	}
+	return batch, nil
+}
+
+// checkOrderCount logs the number of page orders the first time it is seen,
+// so the highest order field can be interpreted, and warns if it changes,
+// which shouldn't happen without a kernel change.
+func checkOrderCount(n int) {
+	switch {
+	case orderCount == 0:
+		logger.Infof("buddyinfo has %d page orders (0-%d), kernel MAX_ORDER %d", n, n-1, n)
+	case n != orderCount:
+		logger.Warnf("buddyinfo page orders changed from %d to %d", orderCount, n)
+	}
+	orderCount = n
+}
+
+// allowed reports whether value is in the allow-list. An empty list allows
+// everything.
+func allowed(list []string, value string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// zoneAllowed reports whether a zone passes --zones and --skip-small-zones,
+// for every collector that reports zones.
+func zoneAllowed(influx InfluxSettings, zone string) bool {
+	if influx.SkipSmallZones && smallZones[zone] {
+		return false
+	}
+	return allowed(influx.Zones, zone)
+}
+
+// emitBatch sends a batch taken at time t to the configured output.
+// It returns the number of points sent.
+func emitBatch(ctx context.Context, conns influxConns, influx InfluxSettings, batch []BuddyEntry, t time.Time) (int, error) {
+	var err error
+	switch {
+	case influx.Listen != "":
+		// In exporter mode, Prometheus scrapes the latest batch instead.
+		promBatch.set(batch)
+	case influx.DryRun:
+		err = printDryRun(os.Stdout, influx, batch, t)
+	case influx.Output == "stdout":
+		err = writeLineProtocol(os.Stdout, influx, batch, t)
+	case influx.Output == "json":
+		err = writeJSON(os.Stdout, influx, batch, t)
+	case influx.Output == "file":
+		err = writeFile(influx, batch, t)
+	case influx.Output == "graphite":
+		err = writeGraphite(influx, batch, t)
+	case influx.Output == "opentsdb":
+		err = writeOpenTSDB(influx, batch, t)
+	default:
+		return updateInflux(ctx, conns, influx, batch, t)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(batch), nil
 }
 
-func updateInflux(influx InfluxSettings, batch []BuddyEntry) error {
+// influxConns are the InfluxDB servers each batch is written to.
+type influxConns []*influxConn
+
+// newInfluxConns returns a connection for each configured destination, with
+// the settings for that destination filled in.
+func newInfluxConns(influx InfluxSettings) influxConns {
+	var conns influxConns
+	for _, dest := range influx.Destinations {
+		settings := influx
+		settings.URL = dest.URL
+		settings.Database = dest.Database
+		settings.User = dest.User
+		settings.Password = dest.Password
+		conns = append(conns, &influxConn{settings: settings})
+	}
+	return conns
+}
+
+// connectInflux pings every destination so a wrong URL or a server that is
+// down shows up at startup rather than on the first write. It logs each
+// server's version, warns about any that can't be reached and returns the
+// last error. A ping doesn't check that the database exists.
+func connectInflux(conns influxConns) error {
+	var lastErr error
+	for _, conn := range conns {
+		if conn.settings.Protocol == "udp" {
+			// UDP is connectionless, so there is nothing to check.
+			continue
+		}
+		version, err := conn.ping()
+		if err != nil {
+			logger.Warnf("InfluxDB at %s is unreachable: %v", conn.settings.URL, err)
+			lastErr = fmt.Errorf("connecting to %s: %v", conn.settings.URL, err)
+			continue
+		}
+		logger.Infof("Connected to InfluxDB %s at %s", version, conn.settings.URL)
+	}
+	return lastErr
+}
+
+// Close releases every connection.
+func (conns influxConns) Close() {
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// influxConn holds an InfluxDB client that is reused across poll cycles.
+// The client is created on first use and recreated after a failed write.
+type influxConn struct {
+	settings InfluxSettings
+	client   client.Client
+	http     *http.Client // Writes not made through client
+	limiter  rateLimiter
+}
+
+// get returns the current client, connecting first if necessary.
+func (ic *influxConn) get() (client.Client, error) {
+	if ic.client != nil {
+		return ic.client, nil
+	}
+	if ic.settings.Protocol == "udp" {
+		return ic.getUDP()
+	}
 	c, err := client.NewHTTPClient(client.HTTPConfig{
-		Addr:     influx.URL,
-		Username: influx.User,
-		Password: influx.Password,
+		Addr:               ic.settings.URL,
+		Username:           ic.settings.User,
+		Password:           ic.settings.Password,
+		Timeout:            ic.settings.WriteTimeout,
+		WriteEncoding:      writeEncoding(ic.settings),
+		InsecureSkipVerify: ic.settings.InsecureSkipVerify,
+		TLSConfig:          ic.settings.TLSConfig,
 	})
+	if err != nil {
+		return nil, err
+	}
+	ic.client = c
+	return c, nil
+}
+
+// writeEncoding returns the client's write body encoding for the settings.
+func writeEncoding(influx InfluxSettings) client.ContentEncoding {
+	if influx.Gzip {
+		return client.GzipEncoding
+	}
+	return client.DefaultEncoding
+}
+
+// ping checks that the server is up and returns its version.
+func (ic *influxConn) ping() (string, error) {
+	if ic.settings.InfluxVersion == 2 || ic.settings.needsHTTPWriter() {
+		return ic.pingHTTP()
+	}
+	c, err := ic.get()
+	if err != nil {
+		return "", err
+	}
+	_, version, err := c.Ping(ic.settings.WriteTimeout)
+	return version, err
+}
+
+// getUDP connects a UDP client to the host and port of a udp:// URL.
+func (ic *influxConn) getUDP() (client.Client, error) {
+	u, err := url.Parse(ic.settings.URL)
+	if err != nil {
+		return nil, err
+	}
+	c, err := client.NewUDPClient(client.UDPConfig{
+		Addr:        u.Host,
+		PayloadSize: ic.settings.UDPPayloadSize,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ic.client = c
+	return c, nil
+}
+
+// reset drops the current client so the next get() reconnects.
+func (ic *influxConn) reset() {
+	if ic.client != nil {
+		ic.client.Close()
+		ic.client = nil
+	}
+}
+
+// Close releases the client, if any.
+func (ic *influxConn) Close() error {
+	if ic.client == nil {
+		return nil
+	}
+	err := ic.client.Close()
+	ic.client = nil
+	return err
+}
+
+// updateInflux writes the batch to InfluxDB. When a spool directory is
+// configured, batches that could not be written are saved there and replayed,
+// oldest first, before the next batch is written. It returns the number of
+// points written.
+func updateInflux(ctx context.Context, conns influxConns, influx InfluxSettings, batch []BuddyEntry, t time.Time) (int, error) {
+	if influx.SpoolDir == "" {
+		if err := writeAll(ctx, conns, batch, t); err != nil {
+			return 0, err
+		}
+		return len(batch), nil
+	}
+
+	err := replaySpool(ctx, conns, influx)
+	if err == nil {
+		err = writeAll(ctx, conns, batch, t)
+	}
+	if err != nil {
+		if serr := spoolBatch(influx, batch, t); serr != nil {
+			logger.Errorf("spooling batch: %v", serr)
+		}
+		return 0, err
+	}
+	return len(batch), nil
+}
+
+// writeAll writes the batch to every destination. It only fails if no
+// destination could be written, so one server being down doesn't leave a gap.
+func writeAll(ctx context.Context, conns influxConns, batch []BuddyEntry, t time.Time) error {
+	var lastErr error
+	written := false
+	for _, conn := range conns {
+		// Config reloads update the settings, so take a copy.
+		configMu.RLock()
+		settings := conn.settings
+		configMu.RUnlock()
+
+		if err := writeBatch(ctx, conn, settings, batch, t); err != nil {
+			logger.Errorf("writing to %s: %v", settings.URL, err)
+			lastErr = err
+			continue
+		}
+		logger.Debugf("Wrote %d entries to %s", len(batch), settings.URL)
+		written = true
+	}
+	if written {
+		return nil
+	}
+	return lastErr
+}
+
+// writeBatch writes the batch to InfluxDB with points stamped from t. With
+// WritePerNode, each node is written separately so one node's failure doesn't
+// stop the others, and the error names the nodes that failed.
+func writeBatch(ctx context.Context, conn *influxConn, influx InfluxSettings, batch []BuddyEntry, t time.Time) error {
+	if !influx.WritePerNode {
+		return writeEntries(ctx, conn, influx, batch, t)
+	}
+
+	var nodes []string
+	byNode := make(map[string][]BuddyEntry)
+	for _, entry := range batch {
+		if _, ok := byNode[entry.Node]; !ok {
+			nodes = append(nodes, entry.Node)
+		}
+		byNode[entry.Node] = append(byNode[entry.Node], entry)
+	}
+
+	var failed []string
+	var lastErr error
+	for _, node := range nodes {
+		if err := writeEntries(ctx, conn, influx, byNode[node], t); err != nil {
+			logger.Errorf("writing node %q to %s: %v", node, influx.URL, err)
+			failed = append(failed, fmt.Sprintf("%q", node))
+			lastErr = err
+			continue
+		}
+		logger.Debugf("Wrote node %q to %s", node, influx.URL)
+	}
+	if lastErr != nil {
+		return fmt.Errorf("writing nodes %s: %v", strings.Join(failed, ", "), lastErr)
+	}
+	return nil
+}
+
+// writeEntries writes entries to InfluxDB in requests of at most BatchSize
+// points.
+func writeEntries(ctx context.Context, conn *influxConn, influx InfluxSettings, batch []BuddyEntry, t time.Time) error {
+	points, err := makePoints(influx, batch, t)
 	if err != nil {
 		return err
 	}
-	defer c.Close()
+
+	// Split large batches to stay under the server's request size limit.
+	// Rewriting a chunk after a partial failure is harmless, since the
+	// points are identical.
+	for len(points) > 0 {
+		chunk := points
+		if influx.BatchSize > 0 && len(chunk) > influx.BatchSize {
+			chunk = chunk[:influx.BatchSize]
+		}
+		points = points[len(chunk):]
+
+		if err := conn.limiter.wait(ctx, influx.MaxWriteRate, len(chunk)); err != nil {
+			return err
+		}
+		if err := writePoints(ctx, conn, influx, chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writePoints writes points to InfluxDB in a single request, with retries.
+// The 1.x client can't abandon a request in flight, so ctx only stops
+// retries there.
+func writePoints(ctx context.Context, conn *influxConn, influx InfluxSettings, points []*client.Point) error {
+	if influx.InfluxVersion == 2 {
+		return writeWithRetry(ctx, influx, func() error {
+			return conn.writeV2(ctx, points)
+		})
+	}
+	if influx.needsHTTPWriter() {
+		return writeWithRetry(ctx, influx, func() error {
+			return conn.writeV1(ctx, points)
+		})
+	}
 
 	// Create a new point batch.
 	bp, err := client.NewBatchPoints(client.BatchPointsConfig{
-		Database:  influx.Database,
-		Precision: "ns",
+		Database:         influx.Database,
+		RetentionPolicy:  influx.RetentionPolicy,
+		Precision:        influx.clientPrecision(),
+		WriteConsistency: influx.Consistency,
 	})
 	if err != nil {
 		return err
 	}
+	bp.AddPoints(points)
 
-	// Time will be incremented by a nanosecond per each data point, to
-	// prevent multiple points from clobbering each other.
-	// Since time.Now() does not have nanosecond precision on all OSes, running
-	// it in a loop can easily net identical times.
-	//
-	// NOTE: Now storing node/zone as tags instead of fields, which should
-	// prevent the overwrite, but it doesn't hurt to leave the increment in just
-	// in case.
+	return writeWithRetry(ctx, influx, func() error {
+		c, err := conn.get()
+		if err != nil {
+			return err
+		}
+		if err := c.Write(bp); err != nil {
+			conn.reset()
+			return err
+		}
+		return nil
+	})
+}
+
+// writeWithRetry calls write until it succeeds, influx.WriteRetries retries
+// are used up or ctx is cancelled, returning the last error. The delay between
+// attempts starts at one second and doubles each time, capped at the poll
+// interval.
+func writeWithRetry(ctx context.Context, influx InfluxSettings, write func() error) error {
+	backoff := time.Second
+	err := write()
+	for retry := 0; err != nil && retry < influx.WriteRetries; retry++ {
+		if backoff > influx.Interval {
+			backoff = influx.Interval
+		}
+		logger.Warnf("Write failed, retrying in %v: %v", backoff, err)
+		select {
+		case <-clk.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+		backoff *= 2
+		err = write()
+	}
+	return err
+}
+
+// makePoints builds an InfluxDB point for each entry in the batch, tagged with
+// the global tags plus node and zone, at time t.
+func makePoints(influx InfluxSettings, batch []BuddyEntry, t time.Time) ([]*client.Point, error) {
+	// All points in a batch share the poll time t. Node and zone are tags, so
+	// each point belongs to its own series and they can't overwrite each other.
 	//
 	// See https://docs.influxdata.com/influxdb/v1.3/troubleshooting/frequently-asked-questions/#how-does-influxdb-handle-duplicate-points
-	t := time.Now()
 
 	// Add a point for each field set in the batch.
+	points := make([]*client.Point, 0, len(batch))
 	for _, entry := range batch {
-		tags := influx.GlobalTags
-		tags["node"] = entry.Node
-		tags["zone"] = entry.Zone
+		measurement := influx.Measurement
+		zone := entry.Zone
+		if entry.Measurement != "" {
+			measurement = entry.Measurement
+		} else if influx.MeasurementPerZone && zone != "" {
+			// e.g. buddyinfo_normal, with no zone tag.
+			measurement += "_" + strings.ToLower(zone)
+			zone = ""
+		}
 
-		pt, err := client.NewPoint(influx.Measurement, tags, entry.Pages, t)
-		if err != nil {
-			return err
+		tags := pointTags(influx, entry.Node, zone)
+		for k, v := range entry.Tags {
+			tags[k] = v
+		}
+		if measurement == internalMeasurement && influx.NoGlobalTagsOnInternal {
+			tags = make(map[string]string)
+			if host, ok := influx.GlobalTags[influx.HostnameTag]; ok && influx.UseHostname {
+				tags[influx.HostnameTag] = host
+			}
 		}
-		bp.AddPoint(pt)
 
-		t = t.Add(time.Nanosecond)
+		pt, err := client.NewPoint(measurement, tags, entry.Pages, t)
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, pt)
 	}
+	return points, nil
+}
 
-	if err := c.Write(bp); err != nil {
-		return err
+// pointTags returns the global tags plus node and zone, shared by every
+// collector so their points can be correlated. Node and zone are left out
+// when empty, as for buddymon's own metrics.
+func pointTags(influx InfluxSettings, node, zone string) map[string]string {
+	// Copy global tags so per-entry tags don't leak into the shared config.
+	tags := make(map[string]string, len(influx.GlobalTags)+2)
+	for k, v := range influx.GlobalTags {
+		tags[k] = v
+	}
+	if node != "" {
+		tags["node"] = node
 	}
-	return c.Close()
+	if zone != "" {
+		tags["zone"] = zone
+	}
+	return tags
 }
 
 /*
@@ -121,50 +781,267 @@ Node 1, zone   Normal   3888  10304    405    139     50     59     38     19
 // Given a buddyinfo line, returns a field map for InfluxDB with node and zone.
 // Node number and zone should be handled as tags and not fields, since those
 // may be frequently queried (fields are not indexed).
-func makeBuddyEntry(line string) (entry BuddyEntry, err error) {
-	fields := strings.Fields(line)
+//
+// Each order from influx.MinOrder to influx.MaxOrder is recorded as a free
+// block count, as bytes (count * 2^order * page size) with a _bytes suffix,
+// or both, depending on influx.FieldUnits. In addition, a free_bytes field
+// totals the free memory in the zone across all orders.
+func makeBuddyEntry(line string, influx InfluxSettings) (entry BuddyEntry, err error) {
+	// Some container runtimes present the file with a UTF-8 byte order mark,
+	// which strings.Fields doesn't treat as space.
+	fields := strings.Fields(strings.TrimPrefix(line, "\ufeff"))
 	n := len(fields)
-	if n != assertFieldCount {
+	if n < minFieldCount {
 		return entry, fmt.Errorf(
-			"found %d fields in %s (expected %d) in %v",
-			n, buddyPath, assertFieldCount, line)
+			"found %d fields (expected at least %d) in %v",
+			n, minFieldCount, line)
+	}
+
+	// Locate the zone by its label rather than by position, since the node
+	// token isn't always formatted "N," (e.g. "0", "0 ,", or missing).
+	z := -1
+	for i, f := range fields {
+		if f == "zone" {
+			z = i
+			break
+		}
+	}
+	if z < 0 || z+2 >= n {
+		return entry, fmt.Errorf("no zone name and page counts found in %v", line)
+	}
+	zone := strings.TrimSuffix(fields[z+1], ",") // zone type, e.g. Normal
+	pages := fields[z+2:]                        // all subsequent fragment counts
+
+	// Everything between "Node" and "zone" is the node, e.g. 12 from "12,".
+	nodeFields := fields[:z]
+	if len(nodeFields) > 0 && nodeFields[0] == "Node" {
+		nodeFields = nodeFields[1:]
+	}
+	node := strings.Trim(strings.Join(nodeFields, ""), ",")
+	if _, err := strconv.Atoi(node); err != nil {
+		logger.Debugf("no node number in %q, assuming node 0", line)
+		node = "0"
+	}
+
+	if !knownZones[zone] {
+		if influx.StrictZones {
+			return entry, fmt.Errorf("unrecognized zone %q in %v", zone, line)
+		}
+		logger.Warnf("unrecognized zone %q in %v", zone, line)
 	}
-	node := fields[1][0] // extract e.g. 0 from "0,"
-	zone := fields[3]    // zone type, e.g. Normal
-	pages := fields[4:]  // all subsequent fragment counts
 
 	entry = BuddyEntry{}
-	entry.Node = string(node)
-	entry.Zone = string(zone)
+	entry.Node = node
+	entry.Zone = zone
 	entry.Pages = make(map[string]interface{})
 
 	// See proc(5) for info on order (search buddyinfo).
+	//
+	// Fields are named by block size in pages (1p, 2p, 4p, ... 1024p) by
+	// default, or by kernel order (order0, order1, ... order10) when
+	// influx.FieldNaming is "order"; the block at order N is 2^N pages.
 	pageOrder := 1
-	for _, p := range pages {
-		name := fmt.Sprintf("%dp", pageOrder)
-		i, err := strconv.Atoi(p)
+	var freeBytes int64
+	counts := make([]int64, 0, len(pages))
+	for order, p := range pages {
+		name := orderFieldName(influx.FieldNaming, order)
+		i, err := strconv.ParseInt(p, 10, 64)
 		if err != nil {
-			return entry, err
+			return entry, fmt.Errorf("invalid page count %q for %s in %v", p, name, line)
 		}
-		entry.Pages[name] = i
+		size := i * int64(pageOrder) * influx.PageSize
+		inRange := order >= influx.MinOrder && (influx.MaxOrder < 0 || order <= influx.MaxOrder)
+		if inRange && influx.FieldUnits != "bytes" {
+			entry.Pages[name] = i
+		}
+		if inRange && influx.FieldUnits != "pages" {
+			entry.Pages[name+"_bytes"] = size
+		}
+		counts = append(counts, i)
+		freeBytes += size
 		pageOrder *= 2
 	}
+	entry.Pages["free_bytes"] = freeBytes
+	entry.Pages["max_free_order"] = maxFreeOrder(counts)
+	entry.Pages["frag_score"] = fragScore(counts)
+	entry.Orders = counts
+
+	if influx.FragOrder >= 0 {
+		name := fmt.Sprintf("frag_index_order_%d", influx.FragOrder)
+		entry.Pages[name] = fragIndex(counts, influx.FragOrder)
+	}
+	if influx.WatchOrder >= 0 {
+		name := fmt.Sprintf("can_alloc_order%d", influx.WatchOrder)
+		entry.Pages[name] = canAlloc(counts, influx.WatchOrder)
+	}
+	if influx.StoreRawLine {
+		entry.Pages["raw"] = line
+	}
+	if influx.CompatNodeField {
+		entry.Pages["node"] = entry.Node
+		entry.Pages["zone"] = entry.Zone
+	}
+
+	if influx.FieldPrefix != "" {
+		prefixed := make(map[string]interface{}, len(entry.Pages))
+		for name, value := range entry.Pages {
+			prefixed[influx.FieldPrefix+name] = value
+		}
+		entry.Pages = prefixed
+	}
 
 	return entry, nil
 }
 
-func slurpLines(path string) ([]string, error) {
+// orderFieldName returns the name of the free block count field for an
+// order: its block size in pages, e.g. 8p, or with naming "order", order3.
+func orderFieldName(naming string, order int) string {
+	if naming == "order" {
+		return fmt.Sprintf("order%d", order)
+	}
+	return fmt.Sprintf("%dp", 1<<uint(order))
+}
+
+// orderRecorded reports whether the order range and --fields left a field
+// for order in the entry, as a block count, in bytes, or both.
+func orderRecorded(influx InfluxSettings, entry BuddyEntry, order int) bool {
+	name := influx.FieldPrefix + orderFieldName(influx.FieldNaming, order)
+	_, pages := entry.Pages[name]
+	_, bytes := entry.Pages[name+"_bytes"]
+	return pages || bytes
+}
+
+// maxFreeOrder returns the highest order with a free block, i.e. the largest
+// contiguous allocation that could succeed now, or -1 if nothing is free.
+func maxFreeOrder(counts []int64) int64 {
+	for order := len(counts) - 1; order >= 0; order-- {
+		if counts[order] > 0 {
+			return int64(order)
+		}
+	}
+	return -1
+}
+
+// canAlloc returns 1 if a block of the given order or higher is free, so an
+// allocation of that order could succeed, else 0.
+func canAlloc(counts []int64, order int) int64 {
+	for o := order; o < len(counts); o++ {
+		if counts[o] > 0 {
+			return 1
+		}
+	}
+	return 0
+}
+
+// fragScore rates how fragmented a zone's free memory is from 0, when every
+// free page is in a block of the highest order, to 100, when every free page
+// is a lone order-0 page. Each free page is weighted by the order of its block
+// over the highest order, and the score is 100 minus the mean weight as a
+// percentage. A zone with no free memory scores 0.
+func fragScore(counts []int64) float64 {
+	maxOrder := len(counts) - 1
+	var freePages, weighted float64
+	for order, count := range counts {
+		pages := float64(count << uint(order))
+		freePages += pages
+		weighted += pages * float64(order)
+	}
+	if freePages == 0 || maxOrder == 0 {
+		return 0
+	}
+	return 100 * (1 - weighted/(freePages*float64(maxOrder)))
+}
+
+// fragIndex computes the external fragmentation index for an allocation of
+// the given order, as in the kernel's extfrag_index (mm/vmstat.c):
+//
+//	index = 1 - (1 + free_pages/2^order) / free_blocks_total
+//
+// where free_pages is the total number of free pages and free_blocks_total is
+// the number of free blocks of any order. Values tending towards 0 mean an
+// allocation would fail for lack of memory; towards 1, for fragmentation.
+// As in the kernel, -1 is returned when a suitable block is free (the
+// allocation would succeed) and 0 when the zone has no free memory at all.
+func fragIndex(counts []int64, order int) float64 {
+	var freePages, blocksTotal, blocksSuitable int64
+	for o, count := range counts {
+		blocksTotal += count
+		freePages += count << uint(o)
+		if o >= order {
+			blocksSuitable += count << uint(o-order)
+		}
+	}
+
+	if blocksTotal == 0 {
+		return 0
+	}
+	if blocksSuitable > 0 {
+		return -1
+	}
+	requested := float64(int64(1) << uint(order))
+	return 1 - (1+float64(freePages)/requested)/float64(blocksTotal)
+}
+
+// slurpLines reads all lines of a /proc file, or a snapshot of one, from the
+// --ssh-host if set.
+// Gzip-compressed files, such as archived buddyinfo snapshots, are
+// decompressed transparently.
+func slurpLines(path string, influx InfluxSettings) ([]string, error) {
 	var lines []string
 
-	data, err := ioutil.ReadFile(path)
-	if err != nil {
-		return lines, err
+	var r io.Reader
+	if influx.SSHHost != "" {
+		data, err := readRemote(influx, path)
+		if err != nil {
+			return lines, err
+		}
+		r = bytes.NewReader(data)
+	} else {
+		f, err := os.Open(path)
+		if err != nil {
+			return lines, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(len(gzipMagic)); strings.HasSuffix(path, ".gz") || bytes.Equal(magic, gzipMagic) {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return lines, fmt.Errorf("%s: %v", path, err)
+		}
+		defer zr.Close()
+		r = zr
+	} else {
+		r = br
 	}
 
-	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	scanner := bufio.NewScanner(r)
+	if influx.MaxLineBytes > 0 {
+		size := 4096
+		if influx.MaxLineBytes < size {
+			size = influx.MaxLineBytes
+		}
+		scanner.Buffer(make([]byte, 0, size), influx.MaxLineBytes)
+	}
 	for scanner.Scan() {
 		lines = append(lines, scanner.Text())
 	}
+	if err := scanner.Err(); err == bufio.ErrTooLong {
+		return lines, fmt.Errorf("%s: line longer than %d bytes, raise --max-line-bytes", path, influx.MaxLineBytes)
+	} else if err != nil {
+		return lines, fmt.Errorf("%s: %v", path, err)
+	}
 
 	return lines, nil
 }
+
+// jitter returns a random duration in [0, max), so that a fleet started
+// together doesn't poll and write in lockstep.
+func jitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
@@ -0,0 +1,1544 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testSettings returns the settings getConfig gives with no flags.
+func testSettings() InfluxSettings {
+	return InfluxSettings{
+		Interval:      10 * time.Second,
+		Path:          defaultBuddyPath,
+		URL:           "http://localhost:8086",
+		Database:      "buddyinfo",
+		Output:        "influx",
+		Measurement:   "buddyinfo",
+		Hostname:      "testhost",
+		UseHostname:   true,
+		HostnameTag:   "host",
+		GlobalTags:    map[string]string{"host": "testhost"},
+		PageSize:      4096,
+		FragOrder:     -1,
+		WatchOrder:    -1,
+		MaxOrder:      -1,
+		AlertOrder:    -1,
+		Precision:     "ns",
+		FieldUnits:    "pages",
+		FieldNaming:   "pages",
+		Protocol:      "http",
+		InfluxVersion: 1,
+		Destinations: []InfluxDestination{
+			{URL: "http://localhost:8086", Database: "buddyinfo"},
+		},
+	}
+}
+
+// useConfig makes influx the global configuration for the rest of the test.
+func useConfig(t *testing.T, influx InfluxSettings) {
+	saved := influxConfig
+	influxConfig = influx
+	t.Cleanup(func() { influxConfig = saved })
+}
+
+// writeTemp writes content to a file in a temporary directory and returns
+// its path.
+func writeTemp(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// fakeInflux is an InfluxDB write endpoint that records the line protocol
+// it receives, or fails writes while fail returns true.
+type fakeInflux struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	bodies  []string
+	queries []url.Values
+	auth    []string
+	fail    func(body string) bool
+}
+
+func newFakeInflux(t *testing.T) *fakeInflux {
+	f := &fakeInflux{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if f.fail != nil && f.fail(string(body)) {
+			http.Error(w, "write failed", http.StatusInternalServerError)
+			return
+		}
+		f.bodies = append(f.bodies, string(body))
+		f.queries = append(f.queries, r.URL.Query())
+		f.auth = append(f.auth, r.Header.Get("Authorization"))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// setFail fails writes whose body fail returns true for, or none if fail
+// is nil.
+func (f *fakeInflux) setFail(fail func(body string) bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fail = fail
+}
+
+// writes returns the body of each successful write.
+func (f *fakeInflux) writes() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.bodies...)
+}
+
+// query returns the query string of the last successful write.
+func (f *fakeInflux) query() url.Values {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.queries) == 0 {
+		return nil
+	}
+	return f.queries[len(f.queries)-1]
+}
+
+// authorization returns the Authorization header of the last successful
+// write.
+func (f *fakeInflux) authorization() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.auth) == 0 {
+		return ""
+	}
+	return f.auth[len(f.auth)-1]
+}
+
+// lines returns every line written, in order.
+func (f *fakeInflux) lines() []string {
+	var lines []string
+	for _, body := range f.writes() {
+		lines = append(lines, strings.Split(strings.TrimSpace(body), "\n")...)
+	}
+	return lines
+}
+
+// settings points influx at the fake server.
+func (f *fakeInflux) settings(influx InfluxSettings) InfluxSettings {
+	influx.URL = f.URL
+	influx.Database = "test"
+	influx.Destinations = []InfluxDestination{{URL: f.URL, Database: "test"}}
+	return influx
+}
+
+// failAll fails every write.
+func failAll(string) bool { return true }
+
+func TestMakeBuddyEntryNode(t *testing.T) {
+	tests := []struct {
+		line string
+		node string
+		zone string
+	}{
+		{"Node 0, zone      DMA      1      1      1      0      2      1      1      0      1      1      3", "0", "DMA"},
+		{"Node 1, zone   Normal   3888  10304    405    139     50     59     38     19      4      2      9", "1", "Normal"},
+		{"Node 10, zone   Normal   1 2 3 4 5 6 7 8 9 10 11", "10", "Normal"},
+		{"Node 12, zone   Normal   1 2 3 4 5 6 7 8 9 10 11", "12", "Normal"},
+		{"Node 127, zone Movable 0 0 0 0 0 0 0 0 0 0 0", "127", "Movable"},
+		{"Node 0 zone Normal 1 2 3", "0", "Normal"},
+		{"Node 7 zone   DMA32 1 2 3", "7", "DMA32"},
+		{"Node 3 , zone Normal 1 2 3", "3", "Normal"},
+		{"Node x zone Normal 1 2 3", "0", "Normal"},
+		{"zone Normal 1 2 3", "0", "Normal"},
+		// A byte order mark, odd spacing and stray commas.
+		{"\ufeffNode 0, zone      DMA      1      1      1", "0", "DMA"},
+		{"\ufeff  Node 2, zone Normal 1 2 3", "2", "Normal"},
+		{"  \tNode 4,\tzone\tNormal\t1\t2\t3  \t", "4", "Normal"},
+		{"Node 6, zone Normal, 1 2 3", "6", "Normal"},
+	}
+	for _, tt := range tests {
+		entry, err := makeBuddyEntry(tt.line, testSettings())
+		if err != nil {
+			t.Errorf("makeBuddyEntry(%q): %v", tt.line, err)
+			continue
+		}
+		if entry.Node != tt.node || entry.Zone != tt.zone {
+			t.Errorf("makeBuddyEntry(%q) = node %q zone %q, want node %q zone %q",
+				tt.line, entry.Node, entry.Zone, tt.node, tt.zone)
+		}
+	}
+}
+
+func TestMakeBuddyEntryFields(t *testing.T) {
+	entry, err := makeBuddyEntry("Node 0, zone   Normal  23821   5715     90     16      8      4      9      2      0      0      0", testSettings())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"1p": int64(23821), "2p": int64(5715), "4p": int64(90), "8p": int64(16),
+		"16p": int64(8), "32p": int64(4), "64p": int64(9), "128p": int64(2),
+		"256p": int64(0), "512p": int64(0), "1024p": int64(0),
+		"free_bytes": int64(150843392), "max_free_order": int64(7),
+		"frag_score": 94.85866348059847,
+	}
+	if !reflect.DeepEqual(entry.Pages, want) {
+		t.Errorf("Pages = %v, want %v", entry.Pages, want)
+	}
+}
+
+func TestMakeBuddyEntryOrderCount(t *testing.T) {
+	tests := []struct {
+		line string
+		want map[string]interface{}
+	}{
+		{
+			// 10 orders, as on kernels built with a smaller MAX_ORDER.
+			"Node 0, zone   Normal 1 2 3 4 5 6 7 8 9 10",
+			map[string]interface{}{
+				"1p": int64(1), "2p": int64(2), "4p": int64(3), "8p": int64(4),
+				"16p": int64(5), "32p": int64(6), "64p": int64(7), "128p": int64(8),
+				"256p": int64(9), "512p": int64(10),
+				"free_bytes":     int64(37752832), // 9217 pages
+				"max_free_order": int64(9),
+				"frag_score":     8.656709220884117,
+			},
+		},
+		{
+			// 14 orders, as on arm64 with 64k pages.
+			"Node 0, zone   Normal 1 1 1 1 1 1 1 1 1 1 1 1 1 1",
+			map[string]interface{}{
+				"1p": int64(1), "2p": int64(1), "4p": int64(1), "8p": int64(1),
+				"16p": int64(1), "32p": int64(1), "64p": int64(1), "128p": int64(1),
+				"256p": int64(1), "512p": int64(1), "1024p": int64(1), "2048p": int64(1),
+				"4096p": int64(1), "8192p": int64(1),
+				"free_bytes":     int64(67104768), // 16383 pages
+				"max_free_order": int64(13),
+				"frag_score":     7.685734274271172,
+			},
+		},
+	}
+	for _, tt := range tests {
+		entry, err := makeBuddyEntry(tt.line, testSettings())
+		if err != nil {
+			t.Errorf("makeBuddyEntry(%q): %v", tt.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(entry.Pages, tt.want) {
+			t.Errorf("makeBuddyEntry(%q) = %v, want %v", tt.line, entry.Pages, tt.want)
+		}
+	}
+}
+
+func TestMakeBuddyEntryFieldUnits(t *testing.T) {
+	const line = "Node 0, zone   Normal 5 2 1"
+	pages := map[string]interface{}{"1p": int64(5), "2p": int64(2), "4p": int64(1)}
+	bytes := map[string]interface{}{"1p_bytes": int64(20480), "2p_bytes": int64(16384), "4p_bytes": int64(16384)}
+	tests := []struct {
+		units string
+		want  []map[string]interface{}
+	}{
+		{"pages", []map[string]interface{}{pages}},
+		{"bytes", []map[string]interface{}{bytes}},
+		{"both", []map[string]interface{}{pages, bytes}},
+	}
+	for _, tt := range tests {
+		influx := testSettings()
+		influx.FieldUnits = tt.units
+		entry, err := makeBuddyEntry(line, influx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]interface{}{
+			"free_bytes": int64(53248), "max_free_order": int64(2), "frag_score": 53.84615384615385,
+		}
+		for _, fields := range tt.want {
+			for k, v := range fields {
+				want[k] = v
+			}
+		}
+		if !reflect.DeepEqual(entry.Pages, want) {
+			t.Errorf("%s: Pages = %v, want %v", tt.units, entry.Pages, want)
+		}
+	}
+}
+
+func TestMakeBuddyEntryPageSize(t *testing.T) {
+	tests := []struct {
+		pageSize int64
+		want     map[string]interface{}
+	}{
+		{4096, map[string]interface{}{
+			"1p_bytes": int64(20480), "2p_bytes": int64(16384), "4p_bytes": int64(16384),
+			"free_bytes": int64(53248),
+		}},
+		// arm64 with 64k pages.
+		{65536, map[string]interface{}{
+			"1p_bytes": int64(327680), "2p_bytes": int64(262144), "4p_bytes": int64(262144),
+			"free_bytes": int64(851968),
+		}},
+	}
+	for _, tt := range tests {
+		influx := testSettings()
+		influx.PageSize = tt.pageSize
+		influx.FieldUnits = "bytes"
+		entry, err := makeBuddyEntry("Node 0, zone   Normal 5 2 1", influx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tt.want["max_free_order"] = int64(2)
+		tt.want["frag_score"] = 53.84615384615385
+		if !reflect.DeepEqual(entry.Pages, tt.want) {
+			t.Errorf("page size %d: Pages = %v, want %v", tt.pageSize, entry.Pages, tt.want)
+		}
+	}
+}
+
+func TestOrderFieldName(t *testing.T) {
+	tests := []struct {
+		naming string
+		order  int
+		want   string
+	}{
+		{"pages", 0, "1p"},
+		{"pages", 3, "8p"},
+		{"pages", 10, "1024p"},
+		{"pages", 13, "8192p"},
+		{"order", 0, "order0"},
+		{"order", 3, "order3"},
+		{"order", 10, "order10"},
+	}
+	for _, tt := range tests {
+		if got := orderFieldName(tt.naming, tt.order); got != tt.want {
+			t.Errorf("orderFieldName(%q, %d) = %q, want %q", tt.naming, tt.order, got, tt.want)
+		}
+	}
+
+	influx := testSettings()
+	influx.FieldNaming = "order"
+	entry, err := makeBuddyEntry("Node 0, zone   Normal 5 2 1", influx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"order0": int64(5), "order1": int64(2), "order2": int64(1),
+		"free_bytes": int64(53248), "max_free_order": int64(2), "frag_score": 53.84615384615385,
+	}
+	if !reflect.DeepEqual(entry.Pages, want) {
+		t.Errorf("Pages = %v, want %v", entry.Pages, want)
+	}
+}
+
+func TestMakeBuddyEntryOrderRange(t *testing.T) {
+	line := "Node 0, zone   Normal 1 2 3 4 5 6 7 8 9 10 11"
+	tests := []struct {
+		name     string
+		min, max int
+		want     map[string]interface{}
+	}{
+		{"high orders", 8, -1, map[string]interface{}{
+			"256p": int64(9), "512p": int64(10), "1024p": int64(11),
+		}},
+		{"low orders", 0, 2, map[string]interface{}{
+			"1p": int64(1), "2p": int64(2), "4p": int64(3),
+		}},
+		{"middle", 3, 5, map[string]interface{}{
+			"8p": int64(4), "16p": int64(5), "32p": int64(6),
+		}},
+		{"single order", 10, 10, map[string]interface{}{
+			"1024p": int64(11),
+		}},
+		{"above the line", 12, -1, map[string]interface{}{}},
+	}
+	for _, tt := range tests {
+		influx := testSettings()
+		influx.MinOrder = tt.min
+		influx.MaxOrder = tt.max
+		entry, err := makeBuddyEntry(line, influx)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		// The summary fields still cover every order.
+		tt.want["free_bytes"] = int64(83890176) // 20481 pages
+		tt.want["max_free_order"] = int64(10)
+		tt.want["frag_score"] = 8.006444997802841
+		if !reflect.DeepEqual(entry.Pages, tt.want) {
+			t.Errorf("%s: Pages = %v, want %v", tt.name, entry.Pages, tt.want)
+		}
+	}
+}
+
+func TestMaxFreeOrder(t *testing.T) {
+	tests := []struct {
+		line string
+		want int64
+	}{
+		{"Node 0, zone      DMA      1      1      1      0      2      1      1      0      1      1      3", 10},
+		{"Node 0, zone    DMA32      3      6      5      3      3      4      2      4      3      1    270", 10},
+		{"Node 0, zone   Normal  23821   5715     90     16      8      4      9      2      0      0      0", 7},
+		{"Node 1, zone   Normal   3888  10304    405    139     50     59     38     19      4      2      9", 10},
+		{"Node 0, zone  Movable      0      0      0      0      0      0      0      0      0      0      0", -1},
+		{"Node 0, zone  Movable      1      0      0      0      0      0      0      0      0      0      0", 0},
+	}
+	for _, tt := range tests {
+		entry, err := makeBuddyEntry(tt.line, testSettings())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := entry.Pages["max_free_order"]; got != tt.want {
+			t.Errorf("max_free_order for %q = %v, want %d", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestCanAlloc(t *testing.T) {
+	normal := "Node 0, zone   Normal  23821   5715     90     16      8      4      9      2      0      0      0"
+	tests := []struct {
+		line  string
+		order int
+		want  int64
+	}{
+		{normal, 0, 1},
+		{normal, 7, 1},
+		// Nothing free at order 8 or above.
+		{normal, 8, 0},
+		{normal, 10, 0},
+		{"Node 0, zone      DMA      1      1      1      0      2      1      1      0      1      1      3", 10, 1},
+		// A free order-3 block can satisfy an order-3 allocation despite
+		// order 4 being empty.
+		{"Node 0, zone  Movable      0      0      0      1      0", 3, 1},
+		{"Node 0, zone  Movable      0      0      0      1      0", 4, 0},
+		{"Node 0, zone  Movable      0      0      0      0      0", 0, 0},
+		// Orders the kernel doesn't have can never be allocated.
+		{"Node 0, zone  Movable      1      1      1", 5, 0},
+	}
+	for _, tt := range tests {
+		influx := testSettings()
+		influx.WatchOrder = tt.order
+		entry, err := makeBuddyEntry(tt.line, influx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := fmt.Sprintf("can_alloc_order%d", tt.order)
+		if got := entry.Pages[name]; got != tt.want {
+			t.Errorf("%s for %q = %v, want %d", name, tt.line, got, tt.want)
+		}
+	}
+
+	entry, err := makeBuddyEntry(normal, testSettings())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name := range entry.Pages {
+		if strings.HasPrefix(name, "can_alloc") {
+			t.Errorf("field %s recorded without --watch-order", name)
+		}
+	}
+}
+
+func TestFragScore(t *testing.T) {
+	tests := []struct {
+		line string
+		want float64
+	}{
+		// Mostly order 10 blocks.
+		{"Node 0, zone      DMA      1      1      1      0      2      1      1      0      1      1      3", 4.25660377358491},
+		{"Node 0, zone    DMA32      3      6      5      3      3      4      2      4      3      1    270", 0.1970319593733727},
+		// Nearly all free pages are order 0 and 1.
+		{"Node 0, zone   Normal  23821   5715     90     16      8      4      9      2      0      0      0", 94.85866348059847},
+		{"Node 1, zone   Normal   3888  10304    405    139     50     59     38     19      4      2      9", 60.688037529319786},
+		{"Node 0, zone  Movable      0      0      0      0      0      0      0      0      0      0      1", 0},
+		{"Node 0, zone  Movable      1      0      0      0      0      0      0      0      0      0      0", 100},
+		{"Node 0, zone  Movable      0      0      0      0      0      0      0      0      0      0      0", 0},
+	}
+	for _, tt := range tests {
+		entry, err := makeBuddyEntry(tt.line, testSettings())
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, ok := entry.Pages["frag_score"].(float64)
+		if !ok || math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("frag_score for %q = %v, want %v", tt.line, entry.Pages["frag_score"], tt.want)
+		}
+	}
+}
+
+func TestFragIndex(t *testing.T) {
+	// The Normal zone has 29665 free blocks holding 36827 free pages and
+	// nothing above order 7; the other sample zones have order 10 blocks.
+	normal := "Node 0, zone   Normal  23821   5715     90     16      8      4      9      2      0      0      0"
+	tests := []struct {
+		line  string
+		order int
+		want  float64
+	}{
+		{"Node 0, zone      DMA      1      1      1      0      2      1      1      0      1      1      3", 10, -1},
+		{"Node 0, zone    DMA32      3      6      5      3      3      4      2      4      3      1    270", 10, -1},
+		{"Node 1, zone   Normal   3888  10304    405    139     50     59     38     19      4      2      9", 10, -1},
+		{normal, 0, -1},
+		{normal, 7, -1},
+		{normal, 8, 0.9951169570621945},  // 1 - (1 + 36827/256) / 29665
+		{normal, 9, 0.9975416236516096},  // 1 - (1 + 36827/512) / 29665
+		{normal, 10, 0.9987539569463172}, // 1 - (1 + 36827/1024) / 29665
+		{"Node 0, zone  Movable 0 0 0 0 0 0 0 0 0 0 0", 3, 0},
+	}
+	for _, tt := range tests {
+		influx := testSettings()
+		influx.FragOrder = tt.order
+		entry, err := makeBuddyEntry(tt.line, influx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := fmt.Sprintf("frag_index_order_%d", tt.order)
+		got, ok := entry.Pages[name].(float64)
+		if !ok || math.Abs(got-tt.want) > 1e-12 {
+			t.Errorf("%s for %q = %v, want %v", name, tt.line, entry.Pages[name], tt.want)
+		}
+	}
+}
+
+func TestMakeBuddyEntryErrors(t *testing.T) {
+	tests := []struct {
+		line string
+		err  string
+	}{
+		{"", "found 0 fields"},
+		{"Node 0, zone Normal", "no zone name and page counts"},
+		{"Node 0, Normal 1 2 3", "no zone name and page counts"},
+		{"Node 0, zone Normal 1 2 x 4 5 6 7 8 9 10 11", `invalid page count "x" for 4p`},
+		{"Node 0, zone Normal 1 2 3 4 5 6 7 8 9 10 -", `invalid page count "-" for 1024p`},
+	}
+	for _, tt := range tests {
+		_, err := makeBuddyEntry(tt.line, testSettings())
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("makeBuddyEntry(%q) error = %v, want %q", tt.line, err, tt.err)
+		}
+	}
+}
+
+func TestReadErrorIsReturned(t *testing.T) {
+	server := newFakeInflux(t)
+	influx := server.settings(testSettings())
+	useConfig(t, influx)
+	conns := newInfluxConns(influx)
+	defer conns.Close()
+	path := filepath.Join(t.TempDir(), "buddyinfo")
+
+	// A missing file fails the cycle without writing, rather than exiting.
+	_, err := processBuddyInfo(context.Background(), conns, influx, path)
+	if err == nil || !strings.Contains(err.Error(), path) {
+		t.Errorf("processBuddyInfo of a missing file: err = %v, want one naming %s", err, path)
+	}
+	if got := server.lines(); len(got) != 0 {
+		t.Errorf("wrote %q after a read error", got)
+	}
+
+	// The next cycle picks up once the file is readable again.
+	if err := ioutil.WriteFile(path, []byte("Node 0, zone Normal 1 2 3 4 5 6 7 8 9 10 11\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := processBuddyInfo(context.Background(), conns, influx, path); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.lines(); len(got) != 1 {
+		t.Errorf("wrote %q, want 1 line", got)
+	}
+}
+
+func TestGlobalTagsNotMutated(t *testing.T) {
+	server := newFakeInflux(t)
+	influx := server.settings(testSettings())
+	influx.GlobalTags = map[string]string{"host": "testhost", "rack": "r12"}
+	useConfig(t, influx)
+	conns := newInfluxConns(influx)
+	defer conns.Close()
+	path := writeTemp(t, "buddyinfo", `Node 0, zone      DMA      1      1      1      0      2      1      1      0      1      1      3
+Node 1, zone   Normal   3888  10304    405    139     50     59     38     19      4      2      9
+`)
+
+	for poll := 0; poll < 2; poll++ {
+		if _, err := processBuddyInfo(context.Background(), conns, influx, path); err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]string{"host": "testhost", "rack": "r12"}
+		if !reflect.DeepEqual(influx.GlobalTags, want) {
+			t.Errorf("poll %d: GlobalTags = %v, want %v", poll, influx.GlobalTags, want)
+		}
+	}
+
+	// Each point keeps its own node and zone.
+	want := []string{
+		"buddyinfo,host=testhost,node=0,rack=r12,zone=DMA ",
+		"buddyinfo,host=testhost,node=1,rack=r12,zone=Normal ",
+	}
+	lines := server.lines()
+	if len(lines) != 4 {
+		t.Fatalf("wrote %q, want 4 lines", lines)
+	}
+	for i, line := range lines {
+		if !strings.HasPrefix(line, want[i%2]) {
+			t.Errorf("line %d = %q, want prefix %q", i, line, want[i%2])
+		}
+	}
+}
+
+func TestBatchSharesTimestamp(t *testing.T) {
+	c := useFakeClock(t)
+	server := newFakeInflux(t)
+	influx := server.settings(testSettings())
+	useConfig(t, influx)
+	conns := newInfluxConns(influx)
+	defer conns.Close()
+	path := writeTemp(t, "buddyinfo", `Node 0, zone      DMA      1      1      1      0      2      1      1      0      1      1      3
+Node 0, zone    DMA32      3      6      5      3      3      4      2      4      3      1    270
+Node 0, zone   Normal  23821   5715     90     16      8      4      9      2      0      0      0
+Node 1, zone   Normal   3888  10304    405    139     50     59     38     19      4      2      9
+`)
+
+	if _, err := processBuddyInfo(context.Background(), conns, influx, path); err != nil {
+		t.Fatal(err)
+	}
+	lines := server.lines()
+	if len(lines) != 4 {
+		t.Fatalf("wrote %q, want 4 lines", lines)
+	}
+	// Every point carries the time the poll started.
+	stamp := strconv.FormatInt(c.Now().UnixNano(), 10)
+	for _, line := range lines {
+		if !strings.HasSuffix(line, " "+stamp) {
+			t.Errorf("line %q, want time %s like the rest of the batch", line, stamp)
+		}
+	}
+}
+
+func TestCollectorsShareOneWrite(t *testing.T) {
+	c := useFakeClock(t)
+	server := newFakeInflux(t)
+	influx := server.settings(testSettings())
+	influx.CollectZoneinfo = true
+	influx.ZoneinfoPath = writeTemp(t, "zoneinfo", `Node 0, zone   Normal
+  pages free     23821
+        min      11253
+`)
+	influx.ZoneinfoMeasurement = "zoneinfo"
+	influx.CollectPagetypeinfo = true
+	influx.PagetypeinfoPath = writeTemp(t, "pagetypeinfo", `Page block order: 9
+Pages per block:  512
+
+Free pages count per migrate type at order       0      1      2
+Node    0, zone   Normal, type      Movable      5      2      1
+`)
+	influx.PagetypeinfoMeasurement = "pagetypeinfo"
+	useConfig(t, influx)
+	conns := newInfluxConns(influx)
+	defer conns.Close()
+	path := writeTemp(t, "buddyinfo", "Node 0, zone   Normal  23821   5715     90\n")
+
+	if _, err := processBuddyInfo(context.Background(), conns, influx, path); err != nil {
+		t.Fatal(err)
+	}
+	if writes := server.writes(); len(writes) != 1 {
+		t.Fatalf("made %d writes, want every collector in one", len(writes))
+	}
+	lines := server.lines()
+	stamp := strconv.FormatInt(c.Now().UnixNano(), 10)
+	for _, measurement := range []string{influx.Measurement, "zoneinfo", "pagetypeinfo"} {
+		found := false
+		for _, line := range lines {
+			if strings.HasPrefix(line, measurement+",") {
+				found = true
+				if !strings.HasSuffix(line, " "+stamp) {
+					t.Errorf("line %q, want time %s like the rest of the batch", line, stamp)
+				}
+			}
+		}
+		if !found {
+			t.Errorf("wrote %q, want a %s point", lines, measurement)
+		}
+	}
+}
+
+func TestSlurpLines(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{"two nodes", `Node 0, zone      DMA      1      1      1      0      2      1      1      0      1      1      3
+Node 0, zone    DMA32      3      4      3      4      4      3      3      3      3      3    621
+Node 0, zone   Normal  23821   5715     90     16      8      4      9      2      0      0      0
+Node 1, zone   Normal   3888  10304    405    139     50     59     38     19      4      2      9
+`, []string{
+			"Node 0, zone      DMA      1      1      1      0      2      1      1      0      1      1      3",
+			"Node 0, zone    DMA32      3      4      3      4      4      3      3      3      3      3    621",
+			"Node 0, zone   Normal  23821   5715     90     16      8      4      9      2      0      0      0",
+			"Node 1, zone   Normal   3888  10304    405    139     50     59     38     19      4      2      9",
+		}},
+		{"no final newline", "a\nb", []string{"a", "b"}},
+		{"blank lines", "a\n\nb\n", []string{"a", "", "b"}},
+		{"crlf", "a\r\nb\r\n", []string{"a", "b"}},
+		{"empty", "", nil},
+	}
+	for _, tt := range tests {
+		lines, err := slurpLines(writeTemp(t, "buddyinfo", tt.content), testSettings())
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(lines, tt.want) {
+			t.Errorf("%s: read %q, want %q", tt.name, lines, tt.want)
+		}
+	}
+
+	if _, err := slurpLines(filepath.Join(t.TempDir(), "missing"), testSettings()); !os.IsNotExist(err) {
+		t.Errorf("reading a missing file returned %v, want a not-exist error", err)
+	}
+}
+
+func TestMaxLineBytes(t *testing.T) {
+	line := "Node 0, zone   Normal" + strings.Repeat("      1", 200)
+	tests := []struct {
+		max int
+		err bool
+	}{
+		{0, false}, // the scanner's default of 64KiB
+		{len(line) + 1, false},
+		{len(line) - 1, true},
+		{100, true},
+	}
+	for _, tt := range tests {
+		influx := testSettings()
+		influx.MaxLineBytes = tt.max
+		lines, err := slurpLines(writeTemp(t, "buddyinfo", "Node 0, zone DMA 1 2 3\n"+line+"\n"), influx)
+		if tt.err {
+			if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("line longer than %d bytes", tt.max)) {
+				t.Errorf("max %d: read %d lines, err %v, want a line too long error", tt.max, len(lines), err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("max %d: %v", tt.max, err)
+			continue
+		}
+		if len(lines) != 2 || lines[1] != line {
+			t.Errorf("max %d: read %d lines, want the long line intact", tt.max, len(lines))
+		}
+	}
+}
+
+func TestSlurpLinesGzip(t *testing.T) {
+	const sample = `Node 0, zone      DMA      1      1      1      0      2      1      1      0      1      1      3
+Node 0, zone   Normal  23821   5715     90     16      8      4      9      2      0      0      0
+`
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(sample))
+	zw.Close()
+
+	want := strings.Split(strings.TrimSpace(sample), "\n")
+	// Detected by the .gz suffix, or by the gzip header when there is none.
+	for _, name := range []string{"buddyinfo.gz", "buddyinfo"} {
+		path := writeTemp(t, name, buf.String())
+		lines, err := slurpLines(path, testSettings())
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !reflect.DeepEqual(lines, want) {
+			t.Errorf("%s: read %q, want %q", name, lines, want)
+		}
+	}
+
+	path := writeTemp(t, "plain.gz", sample)
+	if _, err := slurpLines(path, testSettings()); err == nil {
+		t.Errorf("%s: read uncompressed data without error", path)
+	}
+}
+
+func TestBatchSizeSplitsWrites(t *testing.T) {
+	server := newFakeInflux(t)
+	influx := server.settings(testSettings())
+	influx.BatchSize = 100
+	conn := &influxConn{settings: influx}
+	defer conn.Close()
+
+	batch := make([]BuddyEntry, 250)
+	for i := range batch {
+		batch[i] = BuddyEntry{
+			Node:  strconv.Itoa(i),
+			Zone:  "Normal",
+			Pages: map[string]interface{}{"1p": int64(i)},
+		}
+	}
+	if err := writeBatch(context.Background(), conn, influx, batch, time.Unix(100, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	writes := server.writes()
+	var sizes []int
+	for _, body := range writes {
+		sizes = append(sizes, len(strings.Split(strings.TrimSpace(body), "\n")))
+	}
+	if want := []int{100, 100, 50}; !reflect.DeepEqual(sizes, want) {
+		t.Errorf("wrote batches of %v points, want %v", sizes, want)
+	}
+	if lines := server.lines(); len(lines) != 250 || !strings.Contains(lines[249], "node=249,") {
+		t.Errorf("wrote %d lines ending %q, want all 250 in order", len(lines), lines[len(lines)-1])
+	}
+}
+
+func TestBadLineSkippedAndCounted(t *testing.T) {
+	path := writeTemp(t, "buddyinfo", `Node 0, zone      DMA      1      1      1      0      2      1      1      0      1      1      3
+Node 0, zone    DMA32      3      6      5      3      x      4      2      4      3      1    270
+Node 0, zone   Normal  23821   5715     90     16      8      4      9      2      0      0      0
+`)
+	influx := testSettings()
+	useConfig(t, influx)
+
+	before := atomic.LoadUint64(&parseErrors)
+	batch, err := parseBuddyInfo(path, influx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batch) != 2 || batch[0].Zone != "DMA" || batch[1].Zone != "Normal" {
+		t.Errorf("parsed %v, want the DMA and Normal zones", batch)
+	}
+	if got := atomic.LoadUint64(&parseErrors) - before; got != 1 {
+		t.Errorf("parse errors went up by %d, want 1", got)
+	}
+
+	influx.Strict = true
+	useConfig(t, influx)
+	if batch, err := parseBuddyInfo(path, influx); err == nil {
+		t.Errorf("strict parse = %v, want an error", batch)
+	}
+}
+
+func TestWriteToEachDestination(t *testing.T) {
+	primary, backup := newFakeInflux(t), newFakeInflux(t)
+	influx := primary.settings(testSettings())
+	influx.Destinations = append(influx.Destinations, InfluxDestination{URL: backup.URL, Database: "backup"})
+	conns := newInfluxConns(influx)
+	defer conns.Close()
+	batch := []BuddyEntry{{Node: "0", Zone: "Normal", Pages: map[string]interface{}{"1p": int64(1)}}}
+
+	// One destination down doesn't fail the cycle or stop the other write.
+	primary.setFail(failAll)
+	if _, err := updateInflux(context.Background(), conns, influx, batch, time.Unix(100, 0)); err != nil {
+		t.Errorf("with one destination up: %v", err)
+	}
+	if lines := backup.lines(); len(lines) != 1 {
+		t.Errorf("backup got %q, want 1 line", lines)
+	}
+	if got := backup.query().Get("db"); got != "backup" {
+		t.Errorf("backup written to database %q, want backup", got)
+	}
+
+	// Both down fails it.
+	backup.setFail(failAll)
+	if _, err := updateInflux(context.Background(), conns, influx, batch, time.Unix(200, 0)); err == nil {
+		t.Error("with every destination down: no error")
+	}
+
+	primary.setFail(nil)
+	backup.setFail(nil)
+	if _, err := updateInflux(context.Background(), conns, influx, batch, time.Unix(300, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if p, b := len(primary.lines()), len(backup.lines()); p != 1 || b != 2 {
+		t.Errorf("primary has %d lines and backup %d, want 1 and 2", p, b)
+	}
+}
+
+func TestFieldsAllowList(t *testing.T) {
+	path := writeTemp(t, "buddyinfo", "Node 0, zone Normal 5 2 1\nNode 0, zone DMA 1 1 1\n")
+	tests := []struct {
+		name   string
+		fields []string
+		want   map[string]interface{}
+	}{
+		{"all", nil, map[string]interface{}{
+			"1p": int64(5), "2p": int64(2), "4p": int64(1), "free_bytes": int64(53248),
+			"max_free_order": int64(2), "frag_score": 53.84615384615385,
+		}},
+		{"some", []string{"1p", "free_bytes"}, map[string]interface{}{
+			"1p": int64(5), "free_bytes": int64(53248),
+		}},
+		{"unknown names ignored", []string{"4p", "512p"}, map[string]interface{}{
+			"4p": int64(1),
+		}},
+	}
+	for _, tt := range tests {
+		influx := testSettings()
+		influx.Fields = tt.fields
+		useConfig(t, influx)
+		batch, err := parseBuddyInfo(path, influx)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if len(batch) != 2 || !reflect.DeepEqual(batch[0].Pages, tt.want) {
+			t.Errorf("%s: parsed %v, want Normal with %v", tt.name, batch, tt.want)
+		}
+	}
+
+	// An entry left with no fields is dropped.
+	influx := testSettings()
+	influx.Fields = []string{"nonexistent"}
+	useConfig(t, influx)
+	if batch, err := parseBuddyInfo(path, influx); err != nil || len(batch) != 0 {
+		t.Errorf("parsed %v, %v, want no entries", batch, err)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	for _, max := range []time.Duration{0, -time.Second} {
+		if got := jitter(max); got != 0 {
+			t.Errorf("jitter(%v) = %v, want 0", max, got)
+		}
+	}
+
+	interval := 10 * time.Second
+	max := 2 * time.Second
+	var lowest, highest time.Duration = max, 0
+	for i := 0; i < 1000; i++ {
+		sleep := interval + jitter(max)
+		if sleep < interval || sleep > interval+max {
+			t.Fatalf("sleep %v outside [%v, %v]", sleep, interval, interval+max)
+		}
+		if d := sleep - interval; d < lowest {
+			lowest = d
+		}
+		if d := sleep - interval; d > highest {
+			highest = d
+		}
+	}
+	// 1000 draws should land in both the bottom and top tenth of the range.
+	if lowest > max/10 || highest < max-max/10 {
+		t.Errorf("jitter spanned [%v, %v], want most of [0, %v]", lowest, highest, max)
+	}
+}
+
+func TestCancelDuringWrite(t *testing.T) {
+	tests := []struct {
+		name     string
+		block    bool // hold writes until the client gives up, rather than fail them
+		early    bool // cancel before the poll starts
+		requests int
+	}{
+		{name: "before write", early: true, requests: 0},
+		{name: "request in flight", block: true, requests: 1},
+		{name: "waiting to retry", requests: 1},
+	}
+	for _, tt := range tests {
+		var requests int32
+		started := make(chan struct{}, 10)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			// The server only notices the client hang up once the body is read.
+			ioutil.ReadAll(r.Body)
+			started <- struct{}{}
+			if tt.block {
+				<-r.Context().Done()
+				return
+			}
+			http.Error(w, "write failed", http.StatusInternalServerError)
+		}))
+
+		// Only 2.x writes can be cancelled while in flight; the 1.x client
+		// library doesn't take a context.
+		influx := testSettings()
+		influx.URL = server.URL
+		influx.Destinations = []InfluxDestination{{URL: server.URL}}
+		influx.InfluxVersion = 2
+		influx.Token, influx.Org, influx.Bucket = "token", "org", "bucket"
+		influx.Interval = time.Minute
+		influx.WriteRetries = 5
+		useConfig(t, influx)
+		conns := newInfluxConns(influx)
+		path := writeTemp(t, "buddyinfo", "Node 0, zone Normal 5 2 1\n")
+
+		ctx, cancel := context.WithCancel(context.Background())
+		if tt.early {
+			cancel()
+		}
+		done := make(chan error, 1)
+		go func() {
+			_, err := processBuddyInfo(ctx, conns, influx, path)
+			done <- err
+		}()
+		if !tt.early {
+			<-started
+			cancel()
+		}
+		select {
+		case err := <-done:
+			if err == nil {
+				t.Errorf("%s: cancelled poll succeeded", tt.name)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: poll didn't stop when cancelled", tt.name)
+		}
+		cancel()
+		conns.Close()
+		server.Close()
+		if got := int(atomic.LoadInt32(&requests)); got != tt.requests {
+			t.Errorf("%s: made %d requests, want %d", tt.name, got, tt.requests)
+		}
+	}
+}
+
+func TestPointCount(t *testing.T) {
+	buddyinfo := `Node 0, zone    DMA32      3      6      5
+Node 0, zone   Normal  23821   5715     90
+Node 1, zone   Normal   3888  10304    405
+`
+	tests := []struct {
+		name  string
+		setup func(*InfluxSettings)
+		fail  bool
+		count int
+	}{
+		{"all zones", func(*InfluxSettings) {}, false, 3},
+		{"filtered nodes", func(i *InfluxSettings) { i.Nodes = []string{"1"} }, false, 1},
+		{"filtered zones", func(i *InfluxSettings) { i.Zones = []string{"Normal"} }, false, 2},
+		{"chunked", func(i *InfluxSettings) { i.BatchSize = 2 }, false, 3},
+		{"spooled", func(i *InfluxSettings) { i.SpoolDir = t.TempDir() }, false, 3},
+		{"write failed", func(*InfluxSettings) {}, true, 0},
+		{"write failed and spooled", func(i *InfluxSettings) { i.SpoolDir = t.TempDir() }, true, 0},
+	}
+	for _, tt := range tests {
+		server := newFakeInflux(t)
+		if tt.fail {
+			server.setFail(failAll)
+		}
+		influx := server.settings(testSettings())
+		tt.setup(&influx)
+		useConfig(t, influx)
+		conns := newInfluxConns(influx)
+
+		n, err := processBuddyInfo(context.Background(), conns, influx, writeTemp(t, "buddyinfo", buddyinfo))
+		conns.Close()
+		if (err != nil) != tt.fail {
+			t.Errorf("%s: err = %v, want failure %v", tt.name, err, tt.fail)
+		}
+		if n != tt.count {
+			t.Errorf("%s: returned %d points, want %d", tt.name, n, tt.count)
+		}
+		if got := len(server.lines()); got != n {
+			t.Errorf("%s: returned %d points but wrote %d", tt.name, n, got)
+		}
+	}
+}
+
+func TestWriteConsistency(t *testing.T) {
+	for _, consistency := range []string{"", "any", "one", "quorum", "all"} {
+		server := newFakeInflux(t)
+		influx := server.settings(testSettings())
+		influx.Consistency = consistency
+		conn := &influxConn{settings: influx}
+
+		batch := []BuddyEntry{{Node: "0", Zone: "Normal", Pages: map[string]interface{}{"1p": int64(1)}}}
+		err := writeBatch(context.Background(), conn, influx, batch, time.Unix(100, 0))
+		conn.Close()
+		if err != nil {
+			t.Errorf("consistency %q: %v", consistency, err)
+			continue
+		}
+		if got := server.query().Get("consistency"); got != consistency {
+			t.Errorf("sent consistency=%s, want %q", got, consistency)
+		}
+	}
+}
+
+func TestRewriteIsIdempotent(t *testing.T) {
+	batch := []BuddyEntry{
+		{Node: "0", Zone: "DMA32", Pages: map[string]interface{}{"1p": int64(3)}},
+		{Node: "0", Zone: "Normal", Pages: map[string]interface{}{"1p": int64(23821)}},
+		{Node: "1", Zone: "Normal", Pages: map[string]interface{}{"1p": int64(3888)}},
+	}
+	taken := time.Unix(1500000000, 123456789)
+
+	tests := []struct {
+		name  string
+		setup func(*InfluxSettings)
+	}{
+		{"default", func(*InfluxSettings) {}},
+		{"chunked", func(i *InfluxSettings) { i.BatchSize = 1 }},
+		{"second precision", func(i *InfluxSettings) { i.Precision = "s" }},
+		{"per node", func(i *InfluxSettings) { i.WritePerNode = true }},
+		{"per zone", func(i *InfluxSettings) { i.MeasurementPerZone = true }},
+	}
+	for _, tt := range tests {
+		server := newFakeInflux(t)
+		influx := server.settings(testSettings())
+		tt.setup(&influx)
+		useConfig(t, influx)
+		conns := newInfluxConns(influx)
+
+		// A retried or replayed batch is written again with the time it was
+		// taken, so InfluxDB overwrites each point rather than adding one.
+		for i := 0; i < 2; i++ {
+			if _, err := updateInflux(context.Background(), conns, influx, batch, taken); err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+		}
+		conns.Close()
+		lines := server.lines()
+		if len(lines) != 2*len(batch) {
+			t.Fatalf("%s: wrote %d lines, want %d", tt.name, len(lines), 2*len(batch))
+		}
+		first, second := lines[:len(batch)], lines[len(batch):]
+		if !reflect.DeepEqual(first, second) {
+			t.Errorf("%s: rewrite sent %q, first write %q", tt.name, second, first)
+		}
+
+		// Each point is its own series and time, so none overwrite another.
+		points := make(map[string]bool)
+		for _, line := range first {
+			fields := strings.Fields(line)
+			point := fields[0] + " " + fields[len(fields)-1]
+			if points[point] {
+				t.Errorf("%s: more than one point for %s", tt.name, point)
+			}
+			points[point] = true
+		}
+	}
+}
+
+func TestOrderCount(t *testing.T) {
+	saved := orderCount
+	defer func() { orderCount = saved }()
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	tests := []struct {
+		buddyinfo string
+		count     int
+		log       string
+	}{
+		{"Node 0, zone      DMA      1      1      1      0      2      1      1      0      1      1      3\n", 11, "11 page orders (0-10), kernel MAX_ORDER 11"},
+		{"Node 0, zone   Normal   3888  10304    405    139     50     59     38     19      4      2      9\n", 11, ""},
+		// The first line sets the count.
+		{"Node 0, zone   Normal   1 2 3 4\nNode 0, zone  Movable   1 2\n", 4, "WARNING: buddyinfo page orders changed from 11 to 4"},
+		{"Node 0, zone   Normal   1 2 3 4\n", 4, ""},
+		// A file with no entries leaves the count alone.
+		{"", 4, ""},
+	}
+	orderCount = 0
+	for i, tt := range tests {
+		logged.Reset()
+		if _, err := parseBuddyInfo(writeTemp(t, "buddyinfo", tt.buddyinfo), testSettings()); err != nil {
+			t.Fatalf("poll %d: %v", i, err)
+		}
+		if orderCount != tt.count {
+			t.Errorf("poll %d: order count %d, want %d", i, orderCount, tt.count)
+		}
+		if got := logged.String(); tt.log == "" && got != "" || !strings.Contains(got, tt.log) {
+			t.Errorf("poll %d: logged %q, want %q", i, got, tt.log)
+		}
+	}
+}
+
+func TestWritePerNode(t *testing.T) {
+	batch := []BuddyEntry{
+		{Node: "0", Zone: "Normal", Pages: map[string]interface{}{"1p": int64(1)}},
+		{Node: "1", Zone: "DMA32", Pages: map[string]interface{}{"1p": int64(2)}},
+		{Node: "1", Zone: "Normal", Pages: map[string]interface{}{"1p": int64(3)}},
+		{Node: "2", Zone: "Normal", Pages: map[string]interface{}{"1p": int64(4)}},
+	}
+	tests := []struct {
+		name    string
+		perNode bool
+		fail    []string // nodes whose writes fail
+		written []string // nodes written
+		err     string
+	}{
+		{"combined", false, nil, []string{"0", "1", "1", "2"}, ""},
+		{"combined, one node fails", false, []string{"1"}, nil, "write failed"},
+		{"per node", true, nil, []string{"0", "1", "1", "2"}, ""},
+		{"per node, one node fails", true, []string{"1"}, []string{"0", "2"}, `writing nodes "1": `},
+		{"per node, two nodes fail", true, []string{"0", "2"}, []string{"1", "1"}, `writing nodes "0", "2": `},
+	}
+	for _, tt := range tests {
+		server := newFakeInflux(t)
+		server.setFail(func(body string) bool {
+			for _, node := range tt.fail {
+				if strings.Contains(body, ",node="+node+",") {
+					return true
+				}
+			}
+			return false
+		})
+		influx := server.settings(testSettings())
+		influx.WritePerNode = tt.perNode
+		conns := newInfluxConns(influx)
+
+		err := writeBatch(context.Background(), conns[0], influx, batch, time.Unix(1500000000, 0))
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: err = %v, want %q", tt.name, err, tt.err)
+		}
+		var written []string
+		for _, line := range server.lines() {
+			for _, tag := range strings.Split(strings.Fields(line)[0], ",") {
+				if strings.HasPrefix(tag, "node=") {
+					written = append(written, strings.TrimPrefix(tag, "node="))
+				}
+			}
+		}
+		if !reflect.DeepEqual(written, tt.written) {
+			t.Errorf("%s: wrote nodes %v, want %v", tt.name, written, tt.written)
+		}
+	}
+}
+
+func TestFieldPrefix(t *testing.T) {
+	line := "Node 0, zone   Normal   3888  10304    405    139     50     59     38     19      4      2      9"
+	tests := []struct {
+		name  string
+		setup func(*InfluxSettings)
+	}{
+		{"default", func(*InfluxSettings) {}},
+		{"bytes", func(i *InfluxSettings) { i.FieldUnits = "both" }},
+		{"order naming", func(i *InfluxSettings) { i.FieldNaming = "order" }},
+		{"frag index", func(i *InfluxSettings) { i.FragOrder = 3 }},
+	}
+	for _, tt := range tests {
+		influx := testSettings()
+		tt.setup(&influx)
+		plain, err := makeBuddyEntry(line, influx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		influx.FieldPrefix = "buddy_"
+		prefixed, err := makeBuddyEntry(line, influx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(prefixed.Pages) != len(plain.Pages) {
+			t.Errorf("%s: %d fields with a prefix, %d without", tt.name, len(prefixed.Pages), len(plain.Pages))
+		}
+		for name, value := range plain.Pages {
+			if got, ok := prefixed.Pages["buddy_"+name]; !ok || got != value {
+				t.Errorf("%s: buddy_%s = %v, want %v", tt.name, name, got, value)
+			}
+		}
+	}
+
+	// Outputs that look fields up by name, and --fields, use the prefix.
+	influx := testSettings()
+	influx.FieldPrefix = "buddy_"
+	influx.Fields = []string{"1p", "free_bytes"}
+	influx.AlertOrder = 3
+	influx.AlertThreshold = 1000
+	influx.AlertField = true
+	useConfig(t, influx)
+	batch, err := parseBuddyInfo(writeTemp(t, "buddyinfo", line+"\n"), influx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkAlerts(batch, influx)
+	want := map[string]interface{}{"buddy_1p": int64(3888), "buddy_free_bytes": int64(188596224), "buddy_alert": int64(1)}
+	if len(batch) != 1 || !reflect.DeepEqual(batch[0].Pages, want) {
+		t.Fatalf("parsed %v, want fields %v", batch, want)
+	}
+	if !orderRecorded(influx, batch[0], 0) || orderRecorded(influx, batch[0], 1) {
+		t.Errorf("orderRecorded doesn't match buddy_1p only")
+	}
+}
+
+func TestStoreRawLine(t *testing.T) {
+	line := "Node 0, zone   Normal   3888  10304    405    139     50     59     38     19      4      2      9"
+	for _, store := range []bool{false, true} {
+		influx := testSettings()
+		influx.StoreRawLine = store
+		entry, err := makeBuddyEntry(line, influx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, ok := entry.Pages["raw"]
+		if ok != store || store && raw != line {
+			t.Errorf("store %v: raw = %q, want %q", store, raw, line)
+		}
+	}
+
+	// The line is written as a string field, quotes and all.
+	server := newFakeInflux(t)
+	influx := server.settings(testSettings())
+	influx.StoreRawLine = true
+	entry, err := makeBuddyEntry(line, influx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &influxConn{settings: influx}
+	defer conn.Close()
+	if err := writeBatch(context.Background(), conn, influx, []BuddyEntry{entry}, time.Unix(1500000000, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if lines := server.lines(); len(lines) != 1 || !strings.Contains(lines[0], `raw="`+line+`"`) {
+		t.Errorf("wrote %q, want a raw field of %q", lines, line)
+	}
+}
+
+func TestCompatNodeField(t *testing.T) {
+	line := "Node 1, zone   Normal   3888  10304    405"
+	for _, compat := range []bool{false, true} {
+		influx := testSettings()
+		influx.CompatNodeField = compat
+		entry, err := makeBuddyEntry(line, influx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		node, nodeOK := entry.Pages["node"]
+		zone, zoneOK := entry.Pages["zone"]
+		if nodeOK != compat || zoneOK != compat {
+			t.Errorf("compat %v: node field %v, zone field %v", compat, nodeOK, zoneOK)
+		}
+		if compat && (node != "1" || zone != "Normal") {
+			t.Errorf("node, zone = %v, %v, want 1, Normal", node, zone)
+		}
+	}
+
+	// The fields are written as strings alongside the node and zone tags.
+	server := newFakeInflux(t)
+	influx := server.settings(testSettings())
+	influx.CompatNodeField = true
+	entry, err := makeBuddyEntry(line, influx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &influxConn{settings: influx}
+	defer conn.Close()
+	if err := writeBatch(context.Background(), conn, influx, []BuddyEntry{entry}, time.Unix(1500000000, 0)); err != nil {
+		t.Fatal(err)
+	}
+	lines := server.lines()
+	if len(lines) != 1 {
+		t.Fatalf("wrote %q, want one line", lines)
+	}
+	for _, want := range []string{",node=1", ",zone=Normal", `node="1"`, `zone="Normal"`} {
+		if !strings.Contains(lines[0], want) {
+			t.Errorf("wrote %q, want it to contain %s", lines[0], want)
+		}
+	}
+}
+
+func TestParseBuddyInfoBOM(t *testing.T) {
+	path := writeTemp(t, "buddyinfo", "\ufeffNode 0, zone      DMA      1      1      1\r\n"+
+		"\n"+
+		"   Node 0, zone   Normal   5  2  1   \r\n"+
+		"\ufeff\n")
+	batch, err := parseBuddyInfo(path, testSettings())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []BuddyEntry{
+		{Node: "0", Zone: "DMA", Orders: []int64{1, 1, 1}},
+		{Node: "0", Zone: "Normal", Orders: []int64{5, 2, 1}},
+	}
+	if len(batch) != len(want) {
+		t.Fatalf("parsed %d entries, want %d", len(batch), len(want))
+	}
+	for i := range want {
+		if batch[i].Node != want[i].Node || batch[i].Zone != want[i].Zone || !reflect.DeepEqual(batch[i].Orders, want[i].Orders) {
+			t.Errorf("entry %d = %s/%s %v, want %s/%s %v", i, batch[i].Node, batch[i].Zone, batch[i].Orders,
+				want[i].Node, want[i].Zone, want[i].Orders)
+		}
+	}
+}
+
+func TestReloadDuringSlowWrite(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+	defer server.Close()
+
+	influx := testSettings()
+	influx.Path = writeTemp(t, "buddyinfo", "Node 0, zone Normal 5 2 1\n")
+	influx.URL = server.URL
+	influx.Destinations = []InfluxDestination{{URL: server.URL}}
+	useConfig(t, influx)
+	conns := newInfluxConns(influx)
+
+	polled := make(chan struct{})
+	go func() {
+		poll(context.Background(), conns)
+		close(polled)
+	}()
+	<-started
+
+	// A config reload takes the write lock; it mustn't wait for the write.
+	locked := make(chan struct{})
+	go func() {
+		configMu.Lock()
+		configMu.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Error("config lock blocked by a poll in progress")
+	}
+	close(release)
+	<-polled
+}
+
+func TestMeasurementPerZone(t *testing.T) {
+	tests := []struct {
+		perZone     bool
+		base        string
+		entry       BuddyEntry
+		measurement string
+		zoneTag     string
+	}{
+		{false, "buddyinfo", BuddyEntry{Node: "0", Zone: "Normal"}, "buddyinfo", "Normal"},
+		{true, "buddyinfo", BuddyEntry{Node: "0", Zone: "Normal"}, "buddyinfo_normal", ""},
+		{true, "buddyinfo", BuddyEntry{Node: "0", Zone: "DMA32"}, "buddyinfo_dma32", ""},
+		{true, "mem", BuddyEntry{Node: "1", Zone: "Movable"}, "mem_movable", ""},
+		// Companion collectors keep their own measurement.
+		{true, "buddyinfo", BuddyEntry{Node: "0", Zone: "Normal", Measurement: "zoneinfo"}, "zoneinfo", "Normal"},
+	}
+	for _, tt := range tests {
+		influx := testSettings()
+		influx.Measurement = tt.base
+		influx.MeasurementPerZone = tt.perZone
+		tt.entry.Pages = map[string]interface{}{"1p": int64(1)}
+
+		points, err := makePoints(influx, []BuddyEntry{tt.entry}, time.Unix(1500000000, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pt := points[0]
+		if pt.Name() != tt.measurement || pt.Tags()["zone"] != tt.zoneTag {
+			t.Errorf("per zone %v, zone %s: measurement %q, zone tag %q, want %q, %q",
+				tt.perZone, tt.entry.Zone, pt.Name(), pt.Tags()["zone"], tt.measurement, tt.zoneTag)
+		}
+		if pt.Tags()["node"] != tt.entry.Node {
+			t.Errorf("per zone %v, zone %s: node tag %q, want %q", tt.perZone, tt.entry.Zone, pt.Tags()["node"], tt.entry.Node)
+		}
+	}
+}
+
+func TestSkipSmallZones(t *testing.T) {
+	influx := testSettings()
+	influx.SkipSmallZones = true
+
+	buddyinfo := writeTemp(t, "buddyinfo", `Node 0, zone      DMA      1      1      1
+Node 0, zone    DMA32      3      6      5
+Node 0, zone   Normal  23821   5715     90
+Node 0, zone  Movable      4      2      1
+`)
+	zoneinfo := writeTemp(t, "zoneinfo", `Node 0, zone      DMA
+  pages free     3
+        min      1
+Node 0, zone    DMA32
+  pages free     300
+        min      10
+Node 0, zone   Normal
+  pages free     23821
+        min      11253
+Node 0, zone  Movable
+  pages free     12
+        min      1
+`)
+	pagetypeinfo := writeTemp(t, "pagetypeinfo", `Page block order: 9
+Pages per block:  512
+
+Free pages count per migrate type at order       0      1      2
+Node    0, zone      DMA, type    Unmovable      0      0      0
+Node    0, zone    DMA32, type      Movable      1      1      1
+Node    0, zone   Normal, type      Movable      5      2      1
+Node    0, zone  Movable, type      Movable      4      2      1
+`)
+
+	zones := func(batch []BuddyEntry) []string {
+		var names []string
+		for _, entry := range batch {
+			names = append(names, entry.Zone)
+		}
+		return names
+	}
+	want := []string{"Normal", "Movable"}
+
+	batch, err := parseBuddyInfo(buddyinfo, influx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := zones(batch); !reflect.DeepEqual(got, want) {
+		t.Errorf("buddyinfo zones = %v, want %v", got, want)
+	}
+	batch, err = parseZoneInfo(zoneinfo, "zoneinfo", influx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := zones(batch); !reflect.DeepEqual(got, want) {
+		t.Errorf("zoneinfo zones = %v, want %v", got, want)
+	}
+	batch, err = parsePagetypeInfo(pagetypeinfo, "pagetypeinfo", influx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := zones(batch); !reflect.DeepEqual(got, want) {
+		t.Errorf("pagetypeinfo zones = %v, want %v", got, want)
+	}
+}
+
+func TestWriteWithRetryBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		retries  int
+		waits    []time.Duration
+		fail     bool
+	}{
+		{failures: 0, retries: 3, waits: nil},
+		{failures: 2, retries: 3, waits: []time.Duration{time.Second, 2 * time.Second}},
+		// Capped at the 3s interval.
+		{failures: 5, retries: 4, waits: []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second}, fail: true},
+		{failures: 1, retries: 0, waits: nil, fail: true},
+	}
+	for _, tt := range tests {
+		c := useFakeClock(t)
+		influx := testSettings()
+		influx.Interval = 3 * time.Second
+		influx.WriteRetries = tt.retries
+
+		calls := 0
+		err := writeWithRetry(context.Background(), influx, func() error {
+			calls++
+			if calls <= tt.failures {
+				return fmt.Errorf("failure %d", calls)
+			}
+			return nil
+		})
+		if (err != nil) != tt.fail {
+			t.Errorf("%d failures, %d retries: err = %v, want failure %v", tt.failures, tt.retries, err, tt.fail)
+		}
+		if got := c.Waits(); !reflect.DeepEqual(got, tt.waits) {
+			t.Errorf("%d failures, %d retries: waited %v, want %v", tt.failures, tt.retries, got, tt.waits)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// selfCgroupPath lists the cgroups buddymon runs in.
+const selfCgroupPath = "/proc/self/cgroup"
+
+// readCgroup returns the cgroup path buddymon runs in, for --tag-cgroup.
+func readCgroup() (string, error) {
+	data, err := ioutil.ReadFile(selfCgroupPath)
+	if err != nil {
+		return "", err
+	}
+	return parseCgroup(string(data))
+}
+
+// parseCgroup picks a cgroup path out of /proc/self/cgroup. Each line is
+// hierarchy-ID:controllers:path. Under cgroup v2 there is a single
+// "0::path" line; under v1 there is a line per hierarchy, and the memory
+// controller's is used as the one that matters for fragmentation. Hybrid
+// systems have both, and the memory line still wins.
+func parseCgroup(data string) (string, error) {
+	var unified, first string
+	for _, line := range strings.Split(data, "\n") {
+		parts := strings.SplitN(strings.TrimSpace(line), ":", 3)
+		if len(parts) != 3 || parts[2] == "" {
+			continue
+		}
+		for _, controller := range strings.Split(parts[1], ",") {
+			if controller == "memory" {
+				return checkCgroup(parts[2])
+			}
+		}
+		if parts[0] == "0" && parts[1] == "" {
+			unified = parts[2]
+		} else if first == "" {
+			first = parts[2]
+		}
+	}
+	switch {
+	case unified != "":
+		return checkCgroup(unified)
+	case first != "":
+		return checkCgroup(first)
+	}
+	return "", fmt.Errorf("no cgroup found in %s", selfCgroupPath)
+}
+
+// checkCgroup rejects the root cgroup, which is what a container with its
+// own cgroup namespace sees and says nothing about which one it is.
+func checkCgroup(path string) (string, error) {
+	if path == "/" {
+		return "", fmt.Errorf("%s shows the root cgroup, likely because of a cgroup namespace", selfCgroupPath)
+	}
+	return path, nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseCgroup(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+		err  string
+	}{
+		{"v2", "0::/system.slice/buddymon.service\n", "/system.slice/buddymon.service", ""},
+		{"v2 container", "0::/kubepods/burstable/pod1234/abcdef\n", "/kubepods/burstable/pod1234/abcdef", ""},
+		{"v1", `12:pids:/docker/abcdef
+11:cpu,cpuacct:/docker/abcdef
+4:memory:/docker/abcdef
+1:name=systemd:/docker/abcdef
+`, "/docker/abcdef", ""},
+		{"v1 memory wins", `11:cpu,cpuacct:/user.slice
+5:memory:/docker/abcdef
+1:name=systemd:/init.scope
+`, "/docker/abcdef", ""},
+		{"v1 without memory", `11:cpu,cpuacct:/docker/abcdef
+1:name=systemd:/init.scope
+`, "/docker/abcdef", ""},
+		{"hybrid", `5:memory:/docker/abcdef
+1:name=systemd:/init.scope
+0::/init.scope
+`, "/docker/abcdef", ""},
+		{"hybrid without memory", `1:name=systemd:/init.scope
+0::/system.slice/buddymon.service
+`, "/system.slice/buddymon.service", ""},
+		{"memory among controllers", "3:cpu,memory:/lxc/web\n", "/lxc/web", ""},
+		{"v2 namespaced", "0::/\n", "", "root cgroup"},
+		{"v1 namespaced", "4:memory:/\n1:name=systemd:/\n", "", "root cgroup"},
+		{"empty", "", "", "no cgroup found"},
+		{"malformed", "garbage\n4:memory:\n", "", "no cgroup found"},
+	}
+	for _, tt := range tests {
+		got, err := parseCgroup(tt.data)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: error %v, want one containing %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if got != tt.want {
+			t.Errorf("%s: cgroup = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
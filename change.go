@@ -0,0 +1,60 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"time"
+)
+
+// lastSeen remembers what was last written for each series, for
+// --only-on-change.
+var lastSeen = changeTracker{last: make(map[string]seenEntry)}
+
+type changeTracker struct {
+	last map[string]seenEntry
+}
+
+type seenEntry struct {
+	pages   map[string]interface{}
+	written time.Time
+}
+
+func seriesKey(entry BuddyEntry) string {
+	key := entry.Measurement + "\x00" + entry.Node + "\x00" + entry.Zone
+	for _, k := range sortedTagKeys(entry.Tags) {
+		key += "\x00" + k + "=" + entry.Tags[k]
+	}
+	return key
+}
+
+// sortedTagKeys returns the keys of tags in order, for a stable series key
+// or metric path.
+func sortedTagKeys(tags map[string]string) []string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// changed returns the entries whose fields differ from those last written,
+// plus any not written within maxStale, so idle series stay alive.
+func (c *changeTracker) changed(batch []BuddyEntry, t time.Time, maxStale time.Duration) []BuddyEntry {
+	var out []BuddyEntry
+	for _, entry := range batch {
+		prev, ok := c.last[seriesKey(entry)]
+		if ok && reflect.DeepEqual(prev.pages, entry.Pages) && t.Sub(prev.written) < maxStale {
+			continue
+		}
+		out = append(out, entry)
+	}
+	return out
+}
+
+// record notes that the batch was written at time t.
+func (c *changeTracker) record(batch []BuddyEntry, t time.Time) {
+	for _, entry := range batch {
+		c.last[seriesKey(entry)] = seenEntry{pages: entry.Pages, written: t}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChanged(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	prev := BuddyEntry{Node: "0", Zone: "Normal", Pages: map[string]interface{}{"1p": int64(5)}}
+	tests := []struct {
+		name  string
+		entry BuddyEntry
+		after time.Duration
+		want  bool
+	}{
+		{"unchanged", prev, time.Minute, false},
+		{"field changed", BuddyEntry{Node: "0", Zone: "Normal", Pages: map[string]interface{}{"1p": int64(6)}}, time.Minute, true},
+		{"field added", BuddyEntry{Node: "0", Zone: "Normal", Pages: map[string]interface{}{"1p": int64(5), "2p": int64(0)}}, time.Minute, true},
+		{"new zone", BuddyEntry{Node: "0", Zone: "DMA", Pages: prev.Pages}, time.Minute, true},
+		{"new node", BuddyEntry{Node: "1", Zone: "Normal", Pages: prev.Pages}, time.Minute, true},
+		{"other measurement", BuddyEntry{Node: "0", Zone: "Normal", Pages: prev.Pages, Measurement: "zoneinfo"}, time.Minute, true},
+		{"just fresh", prev, 5*time.Minute - time.Nanosecond, false},
+		{"stale", prev, 5 * time.Minute, true},
+	}
+	for _, test := range tests {
+		c := changeTracker{last: make(map[string]seenEntry)}
+		c.record([]BuddyEntry{prev}, start)
+		got := c.changed([]BuddyEntry{test.entry}, start.Add(test.after), 5*time.Minute)
+		if (len(got) == 1) != test.want {
+			t.Errorf("%s: changed returned %d entries, want changed %v", test.name, len(got), test.want)
+		}
+	}
+}
+
+func TestChangedForcesStaleWrite(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	normal := BuddyEntry{Node: "0", Zone: "Normal", Pages: map[string]interface{}{"1p": int64(5)}}
+	movable := BuddyEntry{Node: "0", Zone: "Movable", Pages: map[string]interface{}{"1p": int64(1)}}
+	c := changeTracker{last: make(map[string]seenEntry)}
+
+	// Poll every minute with nothing changing, recording what was written.
+	var written []int
+	for minute := 0; minute <= 6; minute++ {
+		now := start.Add(time.Duration(minute) * time.Minute)
+		out := c.changed([]BuddyEntry{normal, movable}, now, 5*time.Minute)
+		c.record(out, now)
+		written = append(written, len(out))
+	}
+	// Everything is new at first, then stale five minutes after that.
+	want := []int{2, 0, 0, 0, 0, 2, 0}
+	for i := range want {
+		if written[i] != want[i] {
+			t.Errorf("wrote %v entries per poll, want %v", written, want)
+			break
+		}
+	}
+}
+
+// resetLastSeen forgets what --only-on-change has seen for the rest of the
+// test.
+func resetLastSeen(t *testing.T) {
+	saved := lastSeen
+	lastSeen = changeTracker{last: make(map[string]seenEntry)}
+	t.Cleanup(func() { lastSeen = saved })
+}
+
+func TestOnlyOnChangeMaxStale(t *testing.T) {
+	c := useFakeClock(t)
+	resetLastSeen(t)
+	server := newFakeInflux(t)
+	influx := server.settings(testSettings())
+	influx.OnlyOnChange = true
+	influx.MaxStale = 5 * time.Minute
+	useConfig(t, influx)
+	conns := newInfluxConns(influx)
+	path := writeTemp(t, "buddyinfo", "Node 0, zone Normal 5 2 1\nNode 0, zone Movable 1 1 1\n")
+
+	steps := []struct {
+		advance time.Duration
+		content string // rewrite the file first, if set
+		written int
+	}{
+		{0, "", 2},               // first poll writes everything
+		{time.Minute, "", 0},     // nothing changed
+		{3 * time.Minute, "", 0}, // 4m since written, still fresh
+		{time.Minute, "", 2},     // 5m, forced write of stale series
+		{time.Minute, "Node 0, zone Normal 5 2 1\nNode 0, zone Movable 9 1 1\n", 1},
+		{time.Minute, "", 0},
+	}
+	for i, step := range steps {
+		c.Advance(step.advance)
+		if step.content != "" {
+			if err := ioutil.WriteFile(path, []byte(step.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		before := len(server.lines())
+		n, err := processBuddyInfo(context.Background(), conns, influx, path)
+		if err != nil {
+			t.Fatalf("poll %d: %v", i, err)
+		}
+		lines := server.lines()[before:]
+		if n != step.written || len(lines) != step.written {
+			t.Errorf("poll %d: returned %d and wrote %d points, want %d", i, n, len(lines), step.written)
+		}
+
+		// Points carry the time the poll started.
+		stamp := " " + strconv.FormatInt(c.Now().UnixNano(), 10)
+		for _, line := range lines {
+			if !strings.HasSuffix(line, stamp) {
+				t.Errorf("poll %d: wrote %q, want time%s", i, line, stamp)
+			}
+		}
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import "time"
+
+// clock is the time source for the collection path: point timestamps, the
+// poll loop, write backoff and rate limiting. It's a variable so a fake can
+// stand in for the real clock and make timing deterministic.
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock is the system clock.
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+var clk clock = realClock{}
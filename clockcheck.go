@@ -0,0 +1,35 @@
+package main
+
+import "time"
+
+// clockGranularity estimates the resolution of time.Now() as the smallest
+// non-zero step seen over a number of samples.
+func clockGranularity(samples int) time.Duration {
+	var min time.Duration
+	prev := time.Now()
+	for i := 0; i < samples; {
+		now := time.Now()
+		if d := now.Sub(prev); d > 0 {
+			if min == 0 || d < min {
+				min = d
+			}
+			i++
+		}
+		prev = now
+	}
+	return min
+}
+
+// checkClock logs the clock granularity, warning when it is coarse. On such
+// platforms, consecutive time.Now() calls can return identical times, so
+// per-point time offsets can't keep points apart; the node and zone tags,
+// which give every point in a batch its own series, are what prevent
+// collisions.
+func checkClock() {
+	g := clockGranularity(1000)
+	if g > time.Microsecond {
+		logger.Warnf("Clock granularity is %v; points are kept apart by their node and zone tags, not by timestamp", g)
+		return
+	}
+	logger.Infof("Clock granularity is %v", g)
+}
@@ -1,20 +1,39 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"fmt"
-	"log"
+	"io"
+	"io/ioutil"
+	"net/url"
 	"os"
+	"runtime"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
+	"unicode"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
+// InfluxDestination is one InfluxDB server that batches are written to.
+type InfluxDestination struct {
+	URL      string
+	Database string
+	User     string
+	Password string
+}
+
 // InfluxSettings stores the required configuration to write data points to InfluxDB.
 type InfluxSettings struct {
 	Interval    time.Duration
+	Jitter      time.Duration
+	Path        string // Path to buddyinfo, e.g. a bind-mounted host /proc
 	URL         string
 	Database    string
 	User        string
@@ -22,9 +41,142 @@ type InfluxSettings struct {
 	Measurement string // Measurement name in "SELECT ___ FROM measurement_name"
 	Hostname    string // Local hostname
 	UseHostname bool
+	HostnameTag string // Tag key for Hostname, "host" by default
+	TagKernel   bool   // Add a kernel tag with the kernel release
+	TagArch     bool   // Add an arch tag with the CPU architecture
+	TagCgroup   bool   // Add a cgroup tag with buddymon's own cgroup
 	GlobalTags  map[string]string
+	OneShot     bool   // Poll once and exit instead of looping
+	PageSize    int64  // Bytes per page, used for free_bytes
+	FragOrder   int    // Target order for frag_index_order_N, or -1 to disable
+	WatchOrder  int    // Order for can_alloc_orderN, or -1 to disable
+	FieldUnits  string // Per-order fields as pages, bytes or both
+	FieldNaming string // Per-order field names: pages (1p, 2p...) or order
+	FieldPrefix string // Prepended to every buddyinfo field name
+	MinOrder    int    // Lowest order to record a field for
+	MaxOrder    int    // Highest order to record a field for, or -1 for all
+	Listen      string // Prometheus exporter address; disables InfluxDB writes
+	Output      string // Where to write points: influx, stdout, json, file, graphite or opentsdb
+	StrictZones bool   // Fail on unrecognized zones instead of warning
+	Strict      bool   // Fail the cycle on any bad line instead of skipping it
+	SampleLines int    // Debug log only this many parsed lines; 0 logs all
+	DryRun      bool   // Print points instead of writing them
+	HealthAddr  string // Address to serve /healthz on, if set
+	DebugAddr   string // Address to serve /raw and /parsed on, if set
+	ReplayDir   string // Directory of snapshots to backfill, then exit
+	SelfMetrics bool   // Also write buddymon_internal agent metrics
+
+	// Tag buddymon_internal points with only the hostname tag, not every
+	// global tag, to keep their cardinality low.
+	NoGlobalTagsOnInternal bool
+
+	// Write each zone to <Measurement>_<zone> instead of tagging it.
+	MeasurementPerZone bool
+
+	// Longest line accepted when reading buddyinfo and companion files.
+	MaxLineBytes int
+
+	// Poll when the file at Path changes instead of every Interval.
+	WatchFile bool
+
+	// Record each buddyinfo line verbatim in a raw field, to audit parsing.
+	StoreRawLine bool
+
+	// Also write node and zone as string fields, for queries from before
+	// they became tags.
+	CompatNodeField bool
+
+	// Also record each count's change since the previous poll.
+	EmitDeltas bool
+
+	// Warn when free blocks at AlertOrder fall to AlertThreshold or below.
+	AlertOrder     int   // Page order to watch, or -1 to disable
+	AlertThreshold int64 // Free block count to warn at
+	AlertField     bool  // Also record alert=0/1 on buddyinfo points
+
+	// Skip unchanged series, but write each at least once per MaxStale.
+	OnlyOnChange bool
+	MaxStale     time.Duration
+
+	// Companion /proc/zoneinfo collector for zone watermarks.
+	CollectZoneinfo     bool
+	ZoneinfoPath        string
+	ZoneinfoMeasurement string
+
+	// Companion /proc/pagetypeinfo collector for free blocks by migrate type.
+	CollectPagetypeinfo     bool
+	PagetypeinfoPath        string
+	PagetypeinfoMeasurement string
+
+	// Companion /proc/meminfo collector for overall memory pressure.
+	CollectMeminfo     bool
+	MeminfoPath        string
+	MeminfoMeasurement string
+
+	// Graphite plaintext output, used when Output is graphite.
+	GraphiteAddr   string
+	GraphitePrefix string
+
+	OpenTSDBURL string // OpenTSDB server, used when Output is opentsdb
+
+	// Rotating line protocol file, used when Output is file.
+	OutputFile         string
+	OutputFileMaxBytes int64 // Rotate before growing past this; 0 never rotates
+	OutputFileKeep     int   // Rotated files to keep
+
+	// Remote collection, used when SSHHost is set.
+	SSHHost string // ssh destination, e.g. user@host
+	SSHKey  string // Private key file; empty uses ssh's defaults
+
+	// Allow-lists applied to parsed entries; empty means all.
+	Nodes  []string
+	Zones  []string
+	Fields []string
+
+	SkipSmallZones bool // Drop the DMA and DMA32 zones, even if Zones lists them
+
+	// Every server to write to. URL, Database, User and Password hold the
+	// one being written to, or the first when not writing.
+	Destinations []InfluxDestination
+
+	WriteRetries    int    // Extra write attempts after a failure
+	Precision       string // Timestamp precision: ns, us, ms or s
+	PrecisionTest   bool   // Check clock granularity at startup
+	BatchSize       int    // Max points per write request; 0 is unlimited
+	Protocol        string // InfluxDB 1.x write protocol: http or udp
+	UDPPayloadSize  int    // Max UDP packet size; 0 uses the client default
+	RetentionPolicy string // Empty for the database's default policy
+	Consistency     string // Cluster write consistency; empty for the server default
+	AuthHeader      string // Authorization header for 1.x HTTP writes, instead of User/Password
+	WritePerNode    bool   // Write each NUMA node's points in its own request
+	RequireInflux   bool   // Exit at startup if InfluxDB can't be reached
+	WritePath       string // 1.x write endpoint under URL, instead of /write
+	Gzip            bool   // Compress HTTP write bodies
+
+	MaxWriteRate  float64 // Points per second per server; 0 is unlimited
+	SpoolDir      string  // Where to save batches that fail to write
+	SpoolMaxBytes int64   // Cap on total spool size, oldest dropped first
+
+	WriteTimeout time.Duration // Per-request timeout for HTTP writes; 0 is none
+
+	// TLS settings for HTTPS connections to InfluxDB. TLSConfig is built
+	// from the others by getConfig().
+	CACert             string
+	ClientCert         string
+	ClientKey          string
+	InsecureSkipVerify bool
+	TLSConfig          *tls.Config `json:"-"`
+
+	// InfluxDB 2.x settings, used when InfluxVersion is 2.
+	InfluxVersion int
+	Org           string
+	Bucket        string
+	Token         string
 }
 
+// configMu guards influxConfig against reloads while a poll cycle reads it.
+var configMu sync.RWMutex
+
 func getConfig() InfluxSettings {
 	viper.SetConfigName("buddymon")
 
@@ -34,20 +186,122 @@ func getConfig() InfluxSettings {
 	}
 	defaultHost = strings.ToLower(defaultHost)
 
-	pflag.StringP("config", "c", "", "Config file path (default searches /etc/buddymon, $HOME/buddymon, $PWD)")
+	pflag.BoolP("version", "v", false, "Print version information and exit")
+	pflag.Bool("print-config", false, "Print the resolved configuration as JSON, secrets redacted, and exit")
+	pflag.StringP("config", "c", "", "Config file path (default searches $PWD, $HOME/.buddymon, /etc/buddymon for buddymon.yml, .yaml, .toml or .json)")
+	pflag.String("config-type", "", "Config file format: yaml, toml or json (default from the file extension)")
 	pflag.DurationP("interval", "i", time.Second*10, "How often to gather metrics (units in ms, s, m, h accepted)")
-	pflag.StringP("url", "U", "http://localhost:8086", "InfluxDB server URL")
-	pflag.StringP("database", "d", "buddyinfo", "InfluxDB database name to use")
-	pflag.StringP("user", "u", "", "InfluxDB username for writing")
-	pflag.StringP("password", "p", "", "InfluxDB password for user authentication")
+	pflag.Duration("jitter", 0, "Add a random delay of up to this to each interval, to spread out writes across hosts")
+	pflag.BoolP("oneshot", "1", false, "Gather and write metrics once, then exit")
+	pflag.BoolP("dry-run", "n", false, "Print the points that would be written instead of writing them")
+	pflag.String("replay-dir", "", "Write each buddyinfo snapshot in this directory with its original time, then exit")
+	pflag.StringP("path", "P", defaultBuddyPath, "Path to read buddyinfo from")
+	pflag.Bool("watch-file", false, "Poll when the --path file changes instead of every interval (not for files in /proc)")
+	pflag.String("ssh-host", "", "Read buddyinfo from this host over ssh instead, e.g. user@db1")
+	pflag.String("ssh-key", "", "Private key file for --ssh-host (default uses ssh's own keys and agent)")
+	pflag.Int64("page-size", int64(syscall.Getpagesize()), "Page size in bytes, used to compute free_bytes (default this system's; set it for --ssh-host or snapshots from another architecture)")
+	pflag.Bool("collect-zoneinfo", false, "Also record free pages and watermarks from zoneinfo")
+	pflag.String("zoneinfo-path", defaultZoneinfoPath, "Path to read zoneinfo from")
+	pflag.String("zoneinfo-measurement", "zoneinfo", "InfluxDB measurement name for zoneinfo")
+	pflag.Bool("collect-pagetypeinfo", false, "Also record free blocks per order by migrate type from pagetypeinfo (needs root)")
+	pflag.String("pagetypeinfo-path", defaultPagetypeinfoPath, "Path to read pagetypeinfo from")
+	pflag.String("pagetypeinfo-measurement", "pagetypeinfo", "InfluxDB measurement name for pagetypeinfo")
+	pflag.Bool("collect-meminfo", false, "Also record system memory counters (MemFree, MemAvailable, ...) from meminfo")
+	pflag.String("meminfo-path", defaultMeminfoPath, "Path to read meminfo from")
+	pflag.String("meminfo-measurement", "meminfo", "InfluxDB measurement name for meminfo")
+	pflag.String("field-naming", "pages", "Name per-order fields by block size in pages (1p, 2p, ...) or by order (order0, order1, ...)")
+	pflag.String("field-prefix", "", "Prefix for every buddyinfo field name, e.g. buddy_ for buddy_free_bytes")
+	pflag.Int("min-order", 0, "Lowest page order to record a field for")
+	pflag.Int("max-order", -1, "Highest page order to record a field for (default -1, all)")
+	pflag.String("field-units", "pages", "Record per-order fields as pages (block counts), bytes, or both")
+	pflag.Int("frag-order", -1, "Page order to compute fragmentation index for (frag_index_order_N), -1 to disable")
+	pflag.Int("watch-order", -1, "Record can_alloc_orderN, 1 if a block of order N or higher is free, else 0 (-1 to disable)")
+	pflag.Int("alert-order", -1, "Page order to warn about when its free blocks run low, -1 to disable")
+	pflag.Int64("alert-threshold", 0, "Warn when free blocks at --alert-order are at or below this count")
+	pflag.Bool("alert-field", false, "With --alert-order, also record an alert field (1 when low, else 0)")
+	pflag.String("listen", "", "Serve Prometheus metrics on this address (e.g. :9101) instead of writing to InfluxDB")
+	pflag.String("health-addr", "", "Serve a /healthz endpoint on this address (e.g. :8080)")
+	pflag.String("debug-addr", "", "Serve the last raw and parsed buddyinfo at /raw and /parsed on this address (e.g. localhost:6060)")
+	pflag.StringP("output", "o", "influx", "Where to write points: influx, stdout for line protocol, json for NDJSON, file, graphite or opentsdb")
+	pflag.String("output-file", "", "File to append line protocol to for file output")
+	pflag.Int64("output-file-max-bytes", 100*1024*1024, "Rotate the output file before it grows past this size (0 never rotates)")
+	pflag.Int("output-file-keep", 5, "Rotated output files to keep, named <output-file>.1 and up")
+	pflag.String("opentsdb-url", "", "OpenTSDB server URL for opentsdb output, e.g. http://localhost:4242")
+	pflag.String("graphite-addr", "", "Carbon plaintext host:port for graphite output, e.g. localhost:2003")
+	pflag.String("graphite-prefix", "buddyinfo", "Metric path prefix for graphite output")
+	pflag.Bool("self-metrics", false, "Also write buddymon's own poll and error counts to buddymon_internal")
+	pflag.Bool("no-global-tags-on-internal", false, "Tag buddymon_internal points with only the hostname, not the global tags")
+	pflag.Bool("emit-deltas", false, "Also record each count's change since the previous poll as a <field>_delta field")
+	pflag.Bool("only-on-change", false, "Only write zones whose counts changed since they were last written")
+	pflag.Duration("max-stale", 5*time.Minute, "With --only-on-change, still write unchanged zones this often")
+	pflag.StringSlice("nodes", []string{}, "Only record these nodes, e.g. 0,1 (default all)")
+	pflag.StringSlice("zones", []string{}, "Only record these zones, e.g. Normal,Movable (default all)")
+	pflag.Bool("skip-small-zones", false, "Don't record the small DMA and DMA32 zones")
+	pflag.StringSlice("fields", []string{}, "Only record these fields, e.g. 1p,512p,free_bytes (default all)")
+	pflag.Int("max-line-bytes", 1024*1024, "Longest line to accept from buddyinfo and companion files")
+	pflag.Bool("strict", false, "Discard the whole cycle if any buddyinfo line fails to parse")
+	pflag.Bool("strict-zones", false, "Treat unrecognized zone names as errors instead of warnings")
+	pflag.String("log-format", "text", "Log output format: text or json")
+	pflag.String("log-level", "info", "Minimum level to log: debug, info, warn or error")
+	pflag.Bool("store-raw-line", false, "Also record each buddyinfo line verbatim in a raw string field (uses much more storage)")
+	pflag.Bool("compat-node-field", false, "Also write node and zone as string fields, for dashboards that query them as fields")
+	pflag.Int("sample-lines", 0, "With debug logging, only log the first N parsed lines each cycle (all are still written)")
+	pflag.StringArrayP("url", "U", []string{"http://localhost:8086"}, "InfluxDB server URL, or unix:///path for a local socket (repeat to write to several servers)")
+	pflag.StringArrayP("database", "d", []string{"buddyinfo"}, "InfluxDB database name to use (repeat to set per --url)")
+	pflag.StringArrayP("user", "u", []string{}, "InfluxDB username for writing (repeat to set per --url)")
+	pflag.StringArrayP("password", "p", []string{}, "InfluxDB password for user authentication (or set BUDDYMON_INFLUX_PASSWORD; repeat to set per --url)")
 	pflag.StringP("hostname", "h", defaultHost, "Alternate hostname to use in 'host' tag (-H to bypass)")
 	pflag.BoolP("no-hostname", "H", false, "Do not log a 'host' tag to InfluxDB")
+	pflag.String("hostname-tag", "host", "Tag key to record the hostname under, e.g. hostname")
+	pflag.Bool("tag-arch", false, "Add an 'arch' tag with the CPU architecture, e.g. amd64 or arm64")
+	pflag.Bool("tag-cgroup", false, "Add a 'cgroup' tag with the cgroup buddymon runs in, e.g. a container's")
+	pflag.Bool("tag-kernel", false, "Add a 'kernel' tag with the running kernel release, e.g. 5.15.0-91-generic")
+	pflag.Int("influx-version", 1, "InfluxDB API version to write with (1 or 2)")
+	pflag.String("org", "", "InfluxDB 2.x organization name")
+	pflag.String("bucket", "", "InfluxDB 2.x bucket name")
+	pflag.String("token", "", "InfluxDB 2.x API token (or set BUDDYMON_INFLUX_TOKEN)")
+	pflag.String("retention-policy", "", "InfluxDB retention policy to write to (default uses the database default)")
+	pflag.String("auth-header", "", "Authorization header value for InfluxDB 1.x writes, e.g. 'Bearer xyz' for an auth proxy (or set BUDDYMON_INFLUX_AUTH_HEADER; not with --user)")
+	pflag.String("consistency", "", "InfluxDB Enterprise write consistency: any, one, quorum or all (default uses the server default)")
+	pflag.Bool("precision-test", false, "Check the system clock granularity at startup and warn if it is coarse")
+	pflag.String("precision", "ns", "InfluxDB write timestamp precision: ns, us, ms or s")
+	pflag.String("protocol", "http", "InfluxDB write protocol: http, or udp with --url udp://host:port")
+	pflag.Int("udp-payload-size", 0, "Maximum UDP payload size in bytes (default 0, client default)")
+	pflag.Bool("gzip", false, "Gzip-compress InfluxDB HTTP writes")
+	pflag.String("write-path", "", "InfluxDB 1.x write endpoint path under --url, e.g. /relay/write (default /write)")
+	pflag.Bool("require-influx", false, "Exit at startup if InfluxDB can't be reached, instead of warning")
+	pflag.Bool("write-per-node", false, "Write each NUMA node's points in a separate request, so one failing doesn't lose the rest")
+	pflag.Float64("max-write-rate", 0, "Maximum points per second to write to each InfluxDB server, e.g. for --replay-dir (default 0, unlimited)")
+	pflag.Int("batch-size", 0, "Maximum points per InfluxDB write request (default 0, unlimited)")
+	pflag.Int("write-retries", 2, "Times to retry a failed InfluxDB write, with exponential backoff")
+	pflag.Duration("write-timeout", 10*time.Second, "Give up on an InfluxDB HTTP write after this long (0 waits forever)")
+	pflag.String("spool-dir", "", "Directory to save failed batches in for replay (default disabled)")
+	pflag.Int64("spool-max-bytes", 10*1024*1024, "Maximum total size of spooled batches in bytes")
+	pflag.String("ca-cert", "", "PEM CA certificate file to verify the InfluxDB server with")
+	pflag.String("client-cert", "", "PEM client certificate file for InfluxDB TLS authentication")
+	pflag.String("client-key", "", "PEM client key file for InfluxDB TLS authentication")
+	pflag.Bool("insecure-skip-verify", false, "Do not verify the InfluxDB server certificate (testing only)")
 	pflag.StringP("measurement", "m", "buddyinfo", "InfluxDB measurement name to write")
-	tags := pflag.StringSliceP("tags", "t", []string{}, "InfluxDB tags to add, e.g. host=mycomputer (multiple -t or commas ok)")
+	pflag.Bool("measurement-per-zone", false, "Write each zone to its own measurement, e.g. buddyinfo_normal, instead of a zone tag")
+	pflag.String("tags-file", "", "File of key=value tags to add, one per line (# comments ok; node and zone are reserved)")
+	pflag.String("tags-from-env-prefix", "", "Add a tag for each environment variable with this prefix, e.g. BUDDYMON_TAG_pod=x adds pod=x (node and zone are reserved, so use e.g. BUDDYMON_TAG_k8s_node)")
+	pflag.StringSliceP("tags", "t", []string{}, "InfluxDB tags to add, e.g. host=mycomputer (multiple -t or commas ok; node and zone are reserved)")
 	pflag.Parse()
 
+	if showVersion, _ := pflag.CommandLine.GetBool("version"); showVersion {
+		fmt.Printf("buddymon %s (commit %s, built %s)\n", version, commit, buildDate)
+		os.Exit(0)
+	}
+
 	viper.BindPFlags(pflag.CommandLine)
 
+	// Secrets may come from the environment to keep them out of ps output
+	// and shell history. Viper resolves each setting from, in order: an
+	// explicit flag, the environment, the config file, then the flag default.
+	viper.BindEnv("password", "BUDDYMON_INFLUX_PASSWORD")
+	viper.BindEnv("token", "BUDDYMON_INFLUX_TOKEN")
+	viper.BindEnv("auth-header", "BUDDYMON_INFLUX_AUTH_HEADER")
+
 	configFile := viper.GetString("config")
 	if configFile == "" {
 		// Option -c not specified, search default paths for config file.
@@ -57,45 +311,694 @@ func getConfig() InfluxSettings {
 	} else {
 		viper.SetConfigFile(configFile)
 	}
+	switch configType := viper.GetString("config-type"); configType {
+	case "":
+	case "yaml", "toml", "json":
+		viper.SetConfigType(configType)
+	default:
+		fmt.Fprintf(os.Stderr, "ERROR: Invalid config type '%s', use yaml, toml or json\n", configType)
+		pflag.Usage()
+		os.Exit(8)
+	}
 
-	// TODO: Fix OnConfigChange, currently does not repopulate influxConfig struct.
 	err = viper.ReadInConfig()
-	if err == nil {
-		viper.WatchConfig()
-		viper.OnConfigChange(func(e fsnotify.Event) {
-			log.Println("Configuration reloaded:", e.Name)
-		})
+	if _, notFound := err.(viper.ConfigFileNotFoundError); err != nil && !notFound {
+		// No config file in the search paths is fine, but don't run on
+		// defaults when the user's settings didn't apply.
+		if _, statErr := os.Stat(viper.ConfigFileUsed()); os.IsNotExist(statErr) {
+			fmt.Fprintf(os.Stderr, "ERROR: Config file %s not found\n", viper.ConfigFileUsed())
+		} else {
+			fmt.Fprintf(os.Stderr, "ERROR: Invalid config file %s: %v\n", viper.ConfigFileUsed(), err)
+		}
+		os.Exit(8)
+	}
+
+	// Configure logging first so the rest of setup logs in the right format.
+	switch logFormat := viper.GetString("log-format"); logFormat {
+	case "text":
+	case "json":
+		logger.json = true
+	default:
+		fmt.Fprintf(os.Stderr, "ERROR: Invalid log format '%s', use text or json\n", logFormat)
+		pflag.Usage()
+		os.Exit(8)
+	}
+	logger.level, err = parseLogLevel(viper.GetString("log-level"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v, use debug, info, warn or error\n", err)
+		pflag.Usage()
+		os.Exit(8)
 	}
 
 	// Set config options.
 	var influxConfig InfluxSettings
 	influxConfig.Interval = viper.GetDuration("interval")
-	influxConfig.URL = viper.GetString("url")
-	influxConfig.Database = viper.GetString("database")
-	influxConfig.User = viper.GetString("user")
-	influxConfig.Password = viper.GetString("password")
+	if influxConfig.Interval <= 0 {
+		fmt.Fprintf(os.Stderr, "ERROR: Invalid interval '%s', must be greater than zero\n", viper.GetString("interval"))
+		pflag.Usage()
+		os.Exit(8)
+	}
+	influxConfig.Jitter = viper.GetDuration("jitter")
+	if influxConfig.Jitter < 0 {
+		fmt.Fprintf(os.Stderr, "ERROR: Invalid jitter '%s', must not be negative\n", viper.GetString("jitter"))
+		pflag.Usage()
+		os.Exit(8)
+	}
+	influxConfig.OneShot = viper.GetBool("oneshot")
+	influxConfig.DryRun = viper.GetBool("dry-run")
+	influxConfig.ReplayDir = viper.GetString("replay-dir")
+	influxConfig.Path = viper.GetString("path")
+	influxConfig.WatchFile = viper.GetBool("watch-file")
+	influxConfig.PageSize = viper.GetInt64("page-size")
+	if influxConfig.PageSize <= 0 {
+		fmt.Fprintf(os.Stderr, "ERROR: Invalid page size %d, must be greater than zero\n", influxConfig.PageSize)
+		pflag.Usage()
+		os.Exit(8)
+	}
+	influxConfig.CollectZoneinfo = viper.GetBool("collect-zoneinfo")
+	influxConfig.ZoneinfoPath = viper.GetString("zoneinfo-path")
+	influxConfig.ZoneinfoMeasurement = viper.GetString("zoneinfo-measurement")
+	influxConfig.CollectPagetypeinfo = viper.GetBool("collect-pagetypeinfo")
+	influxConfig.PagetypeinfoPath = viper.GetString("pagetypeinfo-path")
+	influxConfig.PagetypeinfoMeasurement = viper.GetString("pagetypeinfo-measurement")
+	influxConfig.CollectMeminfo = viper.GetBool("collect-meminfo")
+	influxConfig.MeminfoPath = viper.GetString("meminfo-path")
+	influxConfig.MeminfoMeasurement = viper.GetString("meminfo-measurement")
+	influxConfig.FieldPrefix = viper.GetString("field-prefix")
+	influxConfig.FieldNaming = viper.GetString("field-naming")
+	if influxConfig.FieldNaming != "pages" && influxConfig.FieldNaming != "order" {
+		fmt.Fprintf(os.Stderr, "ERROR: Invalid field naming '%s', use pages or order\n", influxConfig.FieldNaming)
+		pflag.Usage()
+		os.Exit(8)
+	}
+	influxConfig.MinOrder = viper.GetInt("min-order")
+	influxConfig.MaxOrder = viper.GetInt("max-order")
+	influxConfig.FieldUnits = viper.GetString("field-units")
+	switch influxConfig.FieldUnits {
+	case "pages", "bytes", "both":
+	default:
+		fmt.Fprintf(os.Stderr, "ERROR: Invalid field units '%s', use pages, bytes or both\n", influxConfig.FieldUnits)
+		pflag.Usage()
+		os.Exit(8)
+	}
+	influxConfig.FragOrder = viper.GetInt("frag-order")
+	influxConfig.WatchOrder = viper.GetInt("watch-order")
+	influxConfig.AlertOrder = viper.GetInt("alert-order")
+	influxConfig.AlertThreshold = viper.GetInt64("alert-threshold")
+	influxConfig.AlertField = viper.GetBool("alert-field")
+	influxConfig.Listen = viper.GetString("listen")
+	influxConfig.HealthAddr = viper.GetString("health-addr")
+	influxConfig.DebugAddr = viper.GetString("debug-addr")
+	influxConfig.Output = viper.GetString("output")
+	switch influxConfig.Output {
+	case "influx", "stdout", "json", "file", "graphite", "opentsdb":
+	default:
+		fmt.Fprintf(os.Stderr, "ERROR: Invalid output '%s', use influx, stdout, json, file, graphite or opentsdb\n", influxConfig.Output)
+		pflag.Usage()
+		os.Exit(8)
+	}
+	influxConfig.GraphiteAddr = viper.GetString("graphite-addr")
+	influxConfig.GraphitePrefix = viper.GetString("graphite-prefix")
+	influxConfig.OpenTSDBURL = viper.GetString("opentsdb-url")
+	influxConfig.OutputFile = viper.GetString("output-file")
+	influxConfig.OutputFileMaxBytes = viper.GetInt64("output-file-max-bytes")
+	influxConfig.OutputFileKeep = viper.GetInt("output-file-keep")
+	influxConfig.SelfMetrics = viper.GetBool("self-metrics")
+	influxConfig.NoGlobalTagsOnInternal = viper.GetBool("no-global-tags-on-internal")
+	influxConfig.EmitDeltas = viper.GetBool("emit-deltas")
+	influxConfig.OnlyOnChange = viper.GetBool("only-on-change")
+	influxConfig.MaxStale = viper.GetDuration("max-stale")
+	influxConfig.Nodes = viper.GetStringSlice("nodes")
+	influxConfig.Zones = viper.GetStringSlice("zones")
+	influxConfig.SkipSmallZones = viper.GetBool("skip-small-zones")
+	influxConfig.Fields = viper.GetStringSlice("fields")
+	influxConfig.Strict = viper.GetBool("strict")
+	influxConfig.MaxLineBytes = viper.GetInt("max-line-bytes")
+	if influxConfig.MaxLineBytes <= 0 {
+		fmt.Fprintf(os.Stderr, "ERROR: Invalid max line bytes %d, must be greater than zero\n", influxConfig.MaxLineBytes)
+		pflag.Usage()
+		os.Exit(8)
+	}
+	influxConfig.SampleLines = viper.GetInt("sample-lines")
+	influxConfig.StoreRawLine = viper.GetBool("store-raw-line")
+	if influxConfig.StoreRawLine {
+		logger.Warnf("Recording raw buddyinfo lines, which greatly increases storage use")
+	}
+	influxConfig.CompatNodeField = viper.GetBool("compat-node-field")
+	influxConfig.StrictZones = viper.GetBool("strict-zones")
+	influxConfig.Destinations, err = getDestinations()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR:", err)
+		pflag.Usage()
+		os.Exit(8)
+	}
+	// The first destination doubles as the default for single-server setups.
+	influxConfig.URL = influxConfig.Destinations[0].URL
+	influxConfig.Database = influxConfig.Destinations[0].Database
+	influxConfig.User = influxConfig.Destinations[0].User
+	influxConfig.Password = influxConfig.Destinations[0].Password
+	influxConfig.InfluxVersion = viper.GetInt("influx-version")
+	if influxConfig.InfluxVersion != 1 && influxConfig.InfluxVersion != 2 {
+		fmt.Fprintf(os.Stderr, "ERROR: Invalid InfluxDB version %d, use 1 or 2\n", influxConfig.InfluxVersion)
+		pflag.Usage()
+		os.Exit(8)
+	}
+	influxConfig.Org = viper.GetString("org")
+	influxConfig.Bucket = viper.GetString("bucket")
+	influxConfig.Token = viper.GetString("token")
+	influxConfig.Protocol = viper.GetString("protocol")
+	influxConfig.UDPPayloadSize = viper.GetInt("udp-payload-size")
+	influxConfig.BatchSize = viper.GetInt("batch-size")
+	influxConfig.MaxWriteRate = viper.GetFloat64("max-write-rate")
+	influxConfig.WritePerNode = viper.GetBool("write-per-node")
+	influxConfig.RequireInflux = viper.GetBool("require-influx")
+	influxConfig.WritePath = viper.GetString("write-path")
+	influxConfig.Gzip = viper.GetBool("gzip")
+	influxConfig.WriteRetries = viper.GetInt("write-retries")
+	influxConfig.WriteTimeout = viper.GetDuration("write-timeout")
+	if influxConfig.WriteTimeout < 0 {
+		fmt.Fprintf(os.Stderr, "ERROR: Invalid write timeout '%s', must not be negative\n", viper.GetString("write-timeout"))
+		pflag.Usage()
+		os.Exit(8)
+	}
+	influxConfig.RetentionPolicy = viper.GetString("retention-policy")
+	influxConfig.AuthHeader = viper.GetString("auth-header")
+	influxConfig.Consistency = viper.GetString("consistency")
+	switch influxConfig.Consistency {
+	case "", "any", "one", "quorum", "all":
+	default:
+		fmt.Fprintf(os.Stderr, "ERROR: Invalid consistency '%s', use any, one, quorum or all\n", influxConfig.Consistency)
+		pflag.Usage()
+		os.Exit(8)
+	}
+	influxConfig.PrecisionTest = viper.GetBool("precision-test")
+	influxConfig.Precision = viper.GetString("precision")
+	switch influxConfig.Precision {
+	case "ns", "us", "ms", "s":
+	default:
+		fmt.Fprintf(os.Stderr, "ERROR: Invalid precision '%s', use ns, us, ms or s\n", influxConfig.Precision)
+		pflag.Usage()
+		os.Exit(8)
+	}
+	influxConfig.SpoolDir = viper.GetString("spool-dir")
+	influxConfig.SpoolMaxBytes = viper.GetInt64("spool-max-bytes")
+	influxConfig.CACert = viper.GetString("ca-cert")
+	influxConfig.ClientCert = viper.GetString("client-cert")
+	influxConfig.ClientKey = viper.GetString("client-key")
+	influxConfig.InsecureSkipVerify = viper.GetBool("insecure-skip-verify")
+	influxConfig.TLSConfig, err = buildTLSConfig(influxConfig)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR: Loading TLS certificates:", err)
+		os.Exit(8)
+	}
 	influxConfig.Measurement = viper.GetString("measurement")
+	influxConfig.MeasurementPerZone = viper.GetBool("measurement-per-zone")
 	influxConfig.Hostname = viper.GetString("hostname")
 	influxConfig.UseHostname = !viper.GetBool("no-hostname")
+	influxConfig.HostnameTag = viper.GetString("hostname-tag")
+	influxConfig.TagKernel = viper.GetBool("tag-kernel")
+	influxConfig.TagArch = viper.GetBool("tag-arch")
+	influxConfig.TagCgroup = viper.GetBool("tag-cgroup")
+	influxConfig.SSHHost = viper.GetString("ssh-host")
+	influxConfig.SSHKey = viper.GetString("ssh-key")
+	if influxConfig.SSHHost != "" && !pflag.CommandLine.Changed("hostname") && !viper.InConfig("hostname") {
+		// Tag remote readings with the remote host, not the poller.
+		remoteHost := influxConfig.SSHHost[strings.LastIndex(influxConfig.SSHHost, "@")+1:]
+		influxConfig.Hostname = strings.ToLower(remoteHost)
+	}
+
+	influxConfig.GlobalTags, err = getTags(influxConfig)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR:", err)
+		pflag.Usage()
+		os.Exit(8)
+	}
+
+	if err := influxConfig.validate(); err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR:", err)
+		os.Exit(8)
+	}
+
+	if viper.GetBool("print-config") {
+		if err := printConfig(os.Stdout, influxConfig); err != nil {
+			fmt.Fprintln(os.Stderr, "ERROR:", err)
+			os.Exit(8)
+		}
+		os.Exit(0)
+	}
+	return influxConfig
+}
+
+// redacted replaces secrets in --print-config output.
+const redacted = "REDACTED"
+
+// printConfig writes the resolved settings as JSON, with passwords, the
+// token and the auth header redacted, to show what the flags, config file
+// and environment added up to. Durations print in nanoseconds.
+func printConfig(w io.Writer, influx InfluxSettings) error {
+	redact := func(s *string) {
+		if *s != "" {
+			*s = redacted
+		}
+	}
+	redact(&influx.Password)
+	redact(&influx.Token)
+	redact(&influx.AuthHeader)
+	dests := make([]InfluxDestination, len(influx.Destinations))
+	copy(dests, influx.Destinations)
+	for i := range dests {
+		redact(&dests[i].Password)
+	}
+	influx.Destinations = dests
+
+	if file := viper.ConfigFileUsed(); file != "" {
+		fmt.Fprintln(os.Stderr, "Config file:", file)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(influx)
+}
+
+// getTags builds the global tags. Tags from --tags-file and the environment
+// are the base; config file or -t tags override them.
+func getTags(influx InfluxSettings) (map[string]string, error) {
+	globalTags := make(map[string]string)
+	if tagsFile := viper.GetString("tags-file"); tagsFile != "" {
+		fileTags, err := readTagsFile(tagsFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading tags file: %v", err)
+		}
+		for k, v := range fileTags {
+			globalTags[k] = v
+		}
+	}
 
-	influxConfig.GlobalTags = viper.GetStringMapString("tags")
-	if len(influxConfig.GlobalTags) == 0 {
+	// Environment tags suit the Kubernetes downward API, e.g. pod names.
+	if prefix := viper.GetString("tags-from-env-prefix"); prefix != "" {
+		for _, kv := range os.Environ() {
+			if !strings.HasPrefix(kv, prefix) {
+				continue
+			}
+			tag := strings.SplitN(strings.TrimPrefix(kv, prefix), "=", 2)
+			globalTags[tag[0]] = tag[1]
+		}
+	}
+
+	configTags := viper.GetStringMapString("tags")
+	for k, v := range configTags {
+		globalTags[k] = v
+	}
+	if len(configTags) == 0 {
 		// Build tags from command line -t if we received them (key=val strings).
-		if len(*tags) > 0 {
-			for _, tagset := range *tags {
-				tag := strings.SplitN(tagset, "=", 2)
-				if len(tag) != 2 {
-					fmt.Fprintf(os.Stderr, "ERROR: Invalid tag '%s', use syntax tag=value\n", tagset)
-					pflag.Usage()
-					os.Exit(8)
+		tags, _ := pflag.CommandLine.GetStringSlice("tags")
+		for _, tagset := range tags {
+			tag := strings.SplitN(tagset, "=", 2)
+			if len(tag) != 2 {
+				return nil, fmt.Errorf("invalid tag '%s', use syntax tag=value", tagset)
+			}
+			globalTags[tag[0]] = tag[1]
+		}
+	}
+
+	if _, ok := globalTags["kernel"]; influx.TagKernel && !ok {
+		release, err := kernelRelease(influx)
+		if err != nil {
+			return nil, fmt.Errorf("reading kernel release: %v", err)
+		}
+		globalTags["kernel"] = release
+	}
+
+	if _, ok := globalTags["arch"]; influx.TagArch && !ok {
+		globalTags["arch"] = runtime.GOARCH
+	}
+
+	if _, ok := globalTags["cgroup"]; influx.TagCgroup && !ok {
+		cgroup, err := readCgroup()
+		if err != nil {
+			return nil, fmt.Errorf("reading cgroup: %v", err)
+		}
+		globalTags["cgroup"] = cgroup
+	}
+
+	if influx.UseHostname == true {
+		if userHost, ok := globalTags[influx.HostnameTag]; ok {
+			logger.Warnf("Using %s tag '%s' from tags instead of hostname '%s'", influx.HostnameTag, userHost, influx.Hostname)
+		} else if influx.Hostname == "" {
+			return nil, fmt.Errorf("hostname is unknown, set --hostname or use --no-hostname")
+		} else {
+			globalTags[influx.HostnameTag] = influx.Hostname
+		}
+	}
+	return globalTags, nil
+}
+
+// osreleasePath holds the running kernel's release, as in uname -r.
+const osreleasePath = "/proc/sys/kernel/osrelease"
+
+// cachedKernelRelease is read once, since it can't change while running.
+var cachedKernelRelease string
+
+// kernelRelease returns the release of the kernel buddyinfo is read from.
+func kernelRelease(influx InfluxSettings) (string, error) {
+	if cachedKernelRelease != "" {
+		return cachedKernelRelease, nil
+	}
+	var data []byte
+	var err error
+	if influx.SSHHost != "" {
+		data, err = readRemote(influx, osreleasePath)
+	} else {
+		data, err = ioutil.ReadFile(osreleasePath)
+	}
+	if err != nil {
+		return "", err
+	}
+	cachedKernelRelease = strings.TrimSpace(string(data))
+	return cachedKernelRelease, nil
+}
+
+// watchConfig reloads the interval, measurement and tags into influxConfig
+// and conns when the config file changes. Other settings, such as InfluxDB
+// connection details, only take effect on restart.
+func watchConfig(conns influxConns) {
+	if viper.ConfigFileUsed() == "" {
+		return
+	}
+	viper.OnConfigChange(func(e fsnotify.Event) {
+		reloaded := influxConfig
+		reloaded.Interval = viper.GetDuration("interval")
+		reloaded.Measurement = viper.GetString("measurement")
+		tags, err := getTags(reloaded)
+		if err == nil {
+			reloaded.GlobalTags = tags
+			err = reloaded.validate()
+		}
+		if err == nil && reloaded.Interval <= 0 {
+			err = fmt.Errorf("interval must be greater than zero")
+		}
+		if err != nil {
+			logger.Errorf("Keeping previous configuration, %s is invalid: %v", e.Name, err)
+			return
+		}
+
+		configMu.Lock()
+		influxConfig = reloaded
+		for _, conn := range conns {
+			conn.settings.Interval = reloaded.Interval
+			conn.settings.Measurement = reloaded.Measurement
+			conn.settings.GlobalTags = reloaded.GlobalTags
+		}
+		configMu.Unlock()
+		logger.Infof("Configuration reloaded: %s", e.Name)
+	})
+	viper.WatchConfig()
+}
+
+// writesInflux reports whether batches are written to InfluxDB, rather than
+// served to Prometheus, printed or sent to another output.
+func (influx InfluxSettings) writesInflux() bool {
+	return influx.Listen == "" && !influx.DryRun && influx.Output == "influx"
+}
+
+// validate checks that the settings needed to write to InfluxDB are present
+// and well formed, so mistakes show up at startup instead of on first write.
+func (influx InfluxSettings) validate() error {
+	writesInflux := influx.writesInflux()
+
+	var problems []string
+	if err := checkMeasurement(influx.Measurement); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if influx.CollectZoneinfo {
+		if err := checkMeasurement(influx.ZoneinfoMeasurement); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if influx.CollectPagetypeinfo {
+		if err := checkMeasurement(influx.PagetypeinfoMeasurement); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if influx.CollectMeminfo {
+		if err := checkMeasurement(influx.MeminfoMeasurement); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if influx.FragOrder < -1 || influx.FragOrder > maxPageOrder {
+		problems = append(problems, fmt.Sprintf("frag-order %d must be -1 or a page order from 0 to %d", influx.FragOrder, maxPageOrder))
+	}
+	if influx.WatchOrder < -1 || influx.WatchOrder > maxPageOrder {
+		problems = append(problems, fmt.Sprintf("watch-order %d must be -1 or a page order from 0 to %d", influx.WatchOrder, maxPageOrder))
+	}
+	if influx.AlertOrder < -1 || influx.AlertOrder > maxPageOrder {
+		problems = append(problems, fmt.Sprintf("alert-order %d must be -1 or a page order from 0 to %d", influx.AlertOrder, maxPageOrder))
+	}
+	if influx.MinOrder < 0 || influx.MinOrder > maxPageOrder {
+		problems = append(problems, fmt.Sprintf("min-order %d must be a page order from 0 to %d", influx.MinOrder, maxPageOrder))
+	}
+	if influx.MaxOrder < -1 || influx.MaxOrder > maxPageOrder {
+		problems = append(problems, fmt.Sprintf("max-order %d must be -1 or a page order from 0 to %d", influx.MaxOrder, maxPageOrder))
+	} else if influx.MaxOrder >= 0 && influx.MaxOrder < influx.MinOrder {
+		problems = append(problems, fmt.Sprintf("max-order %d is below min-order %d", influx.MaxOrder, influx.MinOrder))
+	}
+	for k, v := range influx.GlobalTags {
+		if err := checkTag(k, v); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if influx.SSHHost != "" && influx.ReplayDir != "" {
+		problems = append(problems, "replay-dir reads local snapshots and can't be used with ssh-host")
+	}
+	if influx.SSHHost != "" && influx.TagArch {
+		problems = append(problems, "tag-arch records this machine's architecture and can't be used with ssh-host")
+	}
+	if influx.SSHHost != "" && influx.TagCgroup {
+		problems = append(problems, "tag-cgroup records this process's cgroup and can't be used with ssh-host")
+	}
+	if influx.SSHHost != "" && influx.WatchFile {
+		problems = append(problems, "watch-file only watches local files and can't be used with ssh-host")
+	}
+	if influx.Output == "graphite" && influx.GraphiteAddr == "" {
+		problems = append(problems, "graphite-addr is required for graphite output")
+	}
+	if influx.Output == "opentsdb" && influx.OpenTSDBURL == "" {
+		problems = append(problems, "opentsdb-url is required for opentsdb output")
+	}
+	if influx.Output == "file" && influx.OutputFile == "" {
+		problems = append(problems, "output-file is required for file output")
+	}
+	if influx.OutputFileKeep < 0 {
+		problems = append(problems, "output-file-keep can't be negative")
+	}
+	if writesInflux {
+		for _, dest := range influx.Destinations {
+			if u, err := url.Parse(dest.URL); err != nil {
+				problems = append(problems, fmt.Sprintf("url '%s' is invalid: %v", dest.URL, err))
+			} else if u.Scheme == "unix" {
+				if u.Path == "" {
+					problems = append(problems, fmt.Sprintf("url '%s' needs a socket path, e.g. unix:///var/run/influxdb.sock", dest.URL))
+				}
+				if influx.Protocol == "udp" {
+					problems = append(problems, "unix socket urls can't be used with the udp protocol")
 				}
-				influxConfig.GlobalTags[tag[0]] = tag[1]
+			} else if u.Scheme == "" || u.Host == "" {
+				problems = append(problems, fmt.Sprintf("url '%s' needs a scheme and host, e.g. http://localhost:8086", dest.URL))
+			}
+			if influx.InfluxVersion == 1 && dest.Database == "" {
+				problems = append(problems, fmt.Sprintf("database for '%s' is empty", dest.URL))
+			}
+			// UDP writes are unauthenticated, so don't silently drop credentials.
+			if influx.Protocol == "udp" && (dest.User != "" || dest.Password != "") {
+				problems = append(problems, "user and password can't be used with the udp protocol")
+			}
+			if influx.AuthHeader != "" && (dest.User != "" || dest.Password != "") {
+				problems = append(problems, "auth-header can't be used with user and password")
+			}
+		}
+		if influx.AuthHeader != "" && (influx.Protocol == "udp" || influx.InfluxVersion == 2) {
+			problems = append(problems, "auth-header is only supported for InfluxDB 1.x over http")
+		}
+		if influx.WritePath != "" && (influx.Protocol == "udp" || influx.InfluxVersion == 2) {
+			problems = append(problems, "write-path is only supported for InfluxDB 1.x over http")
+		}
+
+		switch influx.Protocol {
+		case "http":
+		case "udp":
+			if influx.InfluxVersion == 2 {
+				problems = append(problems, "the udp protocol is only supported for InfluxDB 1.x")
+			}
+		default:
+			problems = append(problems, fmt.Sprintf("protocol '%s' is invalid, use http or udp", influx.Protocol))
+		}
+
+		if influx.InfluxVersion == 2 {
+			if influx.Org == "" {
+				problems = append(problems, "org is required for InfluxDB 2.x")
+			}
+			if influx.Bucket == "" {
+				problems = append(problems, "bucket is required for InfluxDB 2.x")
+			}
+			if influx.Token == "" {
+				problems = append(problems, "token is required for InfluxDB 2.x")
 			}
 		}
 	}
 
-	if influxConfig.UseHostname == true {
-		influxConfig.GlobalTags["host"] = influxConfig.Hostname
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration: %s", strings.Join(problems, "; "))
 	}
-	return influxConfig
+	return nil
+}
+
+// buildTLSConfig loads the CA and client certificates named in the settings.
+// It returns nil if none are configured, so the client defaults apply.
+func buildTLSConfig(influx InfluxSettings) (*tls.Config, error) {
+	if influx.CACert == "" && influx.ClientCert == "" && influx.ClientKey == "" && !influx.InsecureSkipVerify {
+		return nil, nil
+	}
+	conf := &tls.Config{InsecureSkipVerify: influx.InsecureSkipVerify}
+
+	if influx.CACert != "" {
+		pem, err := ioutil.ReadFile(influx.CACert)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", influx.CACert)
+		}
+	}
+
+	if influx.ClientCert != "" || influx.ClientKey != "" {
+		if influx.ClientCert == "" || influx.ClientKey == "" {
+			return nil, fmt.Errorf("--client-cert and --client-key must be used together")
+		}
+		cert, err := tls.LoadX509KeyPair(influx.ClientCert, influx.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return conf, nil
+}
+
+// getDestinations pairs each --url with its database, user and password.
+// Each of those may be given once to apply to every URL, or once per URL.
+func getDestinations() ([]InfluxDestination, error) {
+	urls := getStrings("url")
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("at least one url is required")
+	}
+
+	perURL := func(key string) (func(int) string, error) {
+		values := getStrings(key)
+		switch len(values) {
+		case 0:
+			return func(int) string { return "" }, nil
+		case 1:
+			return func(int) string { return values[0] }, nil
+		case len(urls):
+			return func(i int) string { return values[i] }, nil
+		}
+		return nil, fmt.Errorf("got %d %s values for %d urls, give one or one per url", len(values), key, len(urls))
+	}
+	database, err := perURL("database")
+	if err != nil {
+		return nil, err
+	}
+	user, err := perURL("user")
+	if err != nil {
+		return nil, err
+	}
+	password, err := perURL("password")
+	if err != nil {
+		return nil, err
+	}
+
+	dests := make([]InfluxDestination, len(urls))
+	for i, u := range urls {
+		dests[i] = InfluxDestination{URL: u, Database: database(i), User: user(i), Password: password(i)}
+	}
+	return dests, nil
+}
+
+// getStrings returns a setting that may be a single value, e.g. from the
+// environment or a config file, or a list, e.g. from repeated flags.
+func getStrings(key string) []string {
+	switch v := viper.Get(key).(type) {
+	case nil:
+		return nil
+	case string:
+		if v == "" {
+			return nil
+		}
+		return []string{v}
+	default:
+		return viper.GetStringSlice(key)
+	}
+}
+
+// readTagsFile parses a file of key=value tags, one per line. Blank lines and
+// lines starting with # are ignored. The file is always local, even with
+// --ssh-host, like the config file.
+func readTagsFile(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make(map[string]string)
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		tag := strings.SplitN(line, "=", 2)
+		if len(tag) != 2 {
+			return nil, fmt.Errorf("%s:%d: invalid tag '%s', use syntax tag=value", path, n+1, line)
+		}
+		tags[strings.TrimSpace(tag[0])] = strings.TrimSpace(tag[1])
+	}
+	return tags, nil
+}
+
+// checkMeasurement rejects measurement names that would need quoting in
+// InfluxQL, i.e. anything but letters, digits and underscores, or a name
+// starting with a digit.
+func checkMeasurement(name string) error {
+	if name == "" {
+		return fmt.Errorf("measurement is empty")
+	}
+	for i, r := range name {
+		if r == '_' || r < unicode.MaxASCII && unicode.IsLetter(r) || i > 0 && r < unicode.MaxASCII && unicode.IsDigit(r) {
+			continue
+		}
+		return fmt.Errorf("measurement '%s' must be letters, digits and underscores, not starting with a digit", name)
+	}
+	return nil
+}
+
+// checkTag rejects global tags that line protocol can't carry or that would
+// clash with tags buddymon sets itself. Spaces, commas and equals signs are
+// fine, since the InfluxDB client escapes them.
+func checkTag(key, value string) error {
+	switch {
+	case key == "":
+		return fmt.Errorf("tag '=%s' has an empty key", value)
+	case value == "":
+		// InfluxDB silently drops tags with empty values.
+		return fmt.Errorf("tag '%s' has an empty value", key)
+	case key == "node" || key == "zone":
+		return fmt.Errorf("tag '%s' is reserved for the buddyinfo %s", key, key)
+	case key == "time" || strings.HasPrefix(key, "_"):
+		return fmt.Errorf("tag key '%s' is reserved by InfluxDB", key)
+	case strings.IndexFunc(key, unicode.IsControl) >= 0:
+		return fmt.Errorf("tag key %q contains control characters", key)
+	case strings.IndexFunc(value, unicode.IsControl) >= 0:
+		return fmt.Errorf("tag '%s' value %q contains control characters", key, value)
+	case strings.HasSuffix(key, "\\") || strings.HasSuffix(value, "\\"):
+		return fmt.Errorf("tag '%s=%s' can't end with a backslash", key, value)
+	}
+	return nil
 }
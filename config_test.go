@@ -0,0 +1,603 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// configResult marks the settings line in the output of a getConfig child.
+const configResult = "GETCONFIG: "
+
+// runGetConfig runs getConfig in a child process with the given command line
+// arguments and extra environment, since it parses the global flag set and
+// exits on bad settings. It returns the settings, or the child's error and
+// stderr if it exited. HOME is a fresh directory, so only the config file
+// given with --config, if any, is read.
+func runGetConfig(t *testing.T, env []string, args ...string) (InfluxSettings, string, error) {
+	encoded, err := json.Marshal(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestGetConfigHelper$")
+	cmd.Dir = t.TempDir()
+	cmd.Env = append(os.Environ(), "HOME="+cmd.Dir, "BUDDYMON_TEST_ARGS="+string(encoded))
+	cmd.Env = append(cmd.Env, env...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+
+	var influx InfluxSettings
+	if err := cmd.Run(); err != nil {
+		return influx, stderr.String(), err
+	}
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		if strings.HasPrefix(line, configResult) {
+			if err := json.Unmarshal([]byte(line[len(configResult):]), &influx); err != nil {
+				t.Fatal(err)
+			}
+			return influx, stderr.String(), nil
+		}
+	}
+	t.Fatalf("no settings from getConfig child:\n%s%s", stdout.String(), stderr.String())
+	return influx, "", nil
+}
+
+// TestGetConfigHelper isn't a real test: it runs getConfig for runGetConfig.
+func TestGetConfigHelper(t *testing.T) {
+	encoded := os.Getenv("BUDDYMON_TEST_ARGS")
+	if encoded == "" {
+		return
+	}
+	var args []string
+	if err := json.Unmarshal([]byte(encoded), &args); err != nil {
+		t.Fatal(err)
+	}
+	os.Args = append([]string{"buddymon"}, args...)
+
+	influx := getConfig()
+	if reload := os.Getenv("BUDDYMON_TEST_RELOAD"); reload != "" {
+		influx = reloadConfig(t, influx, reload)
+	}
+	influx.TLSConfig = nil // not JSON, and not needed by the tests
+	out, err := json.Marshal(influx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout.WriteString(configResult + string(out) + "\n")
+}
+
+// reloadConfig rewrites the config file getConfig read with content and
+// returns influxConfig once watchConfig has picked up the new interval.
+func reloadConfig(t *testing.T, influx InfluxSettings, content string) InfluxSettings {
+	influxConfig = influx
+	watchConfig(nil)
+	name := viper.ConfigFileUsed()
+
+	// Keep rewriting the file, in case the watcher wasn't ready for the
+	// first write or the file system's timestamps are too coarse to tell
+	// two writes apart.
+	for i := 1; i <= 50; i++ {
+		if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		later := time.Now().Add(time.Duration(i) * time.Second)
+		os.Chtimes(name, later, later)
+		time.Sleep(100 * time.Millisecond)
+
+		configMu.RLock()
+		reloaded := influxConfig
+		configMu.RUnlock()
+		if reloaded.Interval != influx.Interval {
+			return reloaded
+		}
+	}
+	t.Fatal("config file change not picked up")
+	return influx
+}
+
+func TestReloadConfig(t *testing.T) {
+	config := writeTemp(t, "buddymon.yml", "interval: 10s\n")
+	reload := "interval: 30s\nmeasurement: reloaded\ntags:\n  rack: r2\n"
+	influx, stderr, err := runGetConfig(t, []string{"BUDDYMON_TEST_RELOAD=" + reload}, "--config", config, "-h", "myhost")
+	if err != nil {
+		t.Fatalf("%v\n%s", err, stderr)
+	}
+	if influx.Interval != 30*time.Second {
+		t.Errorf("interval = %v after reload, want 30s", influx.Interval)
+	}
+	if influx.Measurement != "reloaded" {
+		t.Errorf("measurement = %q after reload, want reloaded", influx.Measurement)
+	}
+	want := map[string]string{"host": "myhost", "rack": "r2"}
+	if !reflect.DeepEqual(influx.GlobalTags, want) {
+		t.Errorf("tags = %v after reload, want %v", influx.GlobalTags, want)
+	}
+}
+
+func TestSecretsFromEnvironment(t *testing.T) {
+	config := writeTemp(t, "buddymon.yml", "password: from-file\ntoken: file-token\n")
+	tests := []struct {
+		name     string
+		env      []string
+		args     []string
+		password string
+		token    string
+	}{
+		{"config file", nil, []string{"--config", config}, "from-file", "file-token"},
+		{"environment over config file",
+			[]string{"BUDDYMON_INFLUX_PASSWORD=from-env", "BUDDYMON_INFLUX_TOKEN=env-token"},
+			[]string{"--config", config}, "from-env", "env-token"},
+		{"flag over environment",
+			[]string{"BUDDYMON_INFLUX_PASSWORD=from-env", "BUDDYMON_INFLUX_TOKEN=env-token"},
+			[]string{"--config", config, "--password", "from-flag", "--token", "flag-token"}, "from-flag", "flag-token"},
+		{"environment only", []string{"BUDDYMON_INFLUX_PASSWORD=from-env"}, nil, "from-env", ""},
+	}
+	for _, tt := range tests {
+		influx, stderr, err := runGetConfig(t, tt.env, tt.args...)
+		if err != nil {
+			t.Errorf("%s: %v\n%s", tt.name, err, stderr)
+			continue
+		}
+		if influx.Password != tt.password || influx.Token != tt.token {
+			t.Errorf("%s: password %q token %q, want %q and %q",
+				tt.name, influx.Password, influx.Token, tt.password, tt.token)
+		}
+	}
+}
+
+func TestConfigFileErrors(t *testing.T) {
+	broken := writeTemp(t, "broken.json", `{"measurement": "unclosed`)
+	missing := filepath.Join(filepath.Dir(broken), "missing.json")
+	good := writeTemp(t, "buddymon.yml", "measurement: from_file\n")
+
+	tests := []struct {
+		name   string
+		args   []string
+		stderr string // substring of the error, or empty for success
+	}{
+		{"no config file in the search paths", nil, ""},
+		{"valid config file", []string{"--config", good}, ""},
+		{"broken config file", []string{"--config", broken}, "ERROR: Invalid config file " + broken + ": "},
+		{"missing config file", []string{"--config", missing}, "ERROR: Config file " + missing + " not found"},
+	}
+	for _, tt := range tests {
+		_, stderr, err := runGetConfig(t, nil, tt.args...)
+		if tt.stderr == "" {
+			if err != nil {
+				t.Errorf("%s: %v\n%s", tt.name, err, stderr)
+			}
+			continue
+		}
+		if exit, ok := err.(*exec.ExitError); !ok || exit.ExitCode() != 8 {
+			t.Errorf("%s: err = %v, want exit status 8", tt.name, err)
+		}
+		if !strings.Contains(stderr, tt.stderr) {
+			t.Errorf("%s: stderr = %q, want %q", tt.name, stderr, tt.stderr)
+		}
+	}
+
+	// Settings from a valid file apply.
+	influx, stderr, err := runGetConfig(t, nil, "--config", good)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, stderr)
+	}
+	if influx.Measurement != "from_file" {
+		t.Errorf("measurement = %q, want from_file", influx.Measurement)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(*InfluxSettings)
+		err    string // substring of the error, or empty for none
+	}{
+		{"defaults", func(*InfluxSettings) {}, ""},
+		{"empty measurement", func(i *InfluxSettings) { i.Measurement = "" }, "measurement is empty"},
+		{"measurement with underscores and digits", func(i *InfluxSettings) { i.Measurement = "buddy_info2" }, ""},
+		{"measurement with spaces", func(i *InfluxSettings) { i.Measurement = "buddy info" }, "measurement 'buddy info' must be"},
+		{"measurement with a dash", func(i *InfluxSettings) { i.Measurement = "buddy-info" }, "measurement 'buddy-info' must be"},
+		{"measurement starting with a digit", func(i *InfluxSettings) { i.Measurement = "2buddy" }, "measurement '2buddy' must be"},
+		{"non-ASCII measurement", func(i *InfluxSettings) { i.Measurement = "büddy" }, "measurement 'büddy' must be"},
+		{"bad zoneinfo measurement", func(i *InfluxSettings) { i.CollectZoneinfo = true; i.ZoneinfoMeasurement = "zone info" }, "measurement 'zone info' must be"},
+		{"zoneinfo measurement unused", func(i *InfluxSettings) { i.ZoneinfoMeasurement = "zone info" }, ""},
+		{"unparseable url", func(i *InfluxSettings) { i.Destinations[0].URL = "http://[::1" }, "is invalid"},
+		{"url without scheme", func(i *InfluxSettings) { i.Destinations[0].URL = "localhost:8086" }, "needs a scheme and host"},
+		{"empty database", func(i *InfluxSettings) { i.Destinations[0].Database = "" }, "database for 'http://localhost:8086' is empty"},
+		{"second destination checked", func(i *InfluxSettings) {
+			i.Destinations = append(i.Destinations, InfluxDestination{URL: "backup:8086", Database: "b"})
+		}, "url 'backup:8086' needs a scheme and host"},
+		{"v2 without org", func(i *InfluxSettings) { i.InfluxVersion, i.Bucket, i.Token = 2, "b", "t" }, "org is required"},
+		{"v2 without bucket", func(i *InfluxSettings) { i.InfluxVersion, i.Org, i.Token = 2, "o", "t" }, "bucket is required"},
+		{"v2 without token", func(i *InfluxSettings) { i.InfluxVersion, i.Org, i.Bucket = 2, "o", "b" }, "token is required"},
+		{"v2 complete", func(i *InfluxSettings) { i.InfluxVersion, i.Org, i.Bucket, i.Token = 2, "o", "b", "t" }, ""},
+		{"stdout needs no server", func(i *InfluxSettings) { i.Output, i.URL, i.Database = "stdout", "", "" }, ""},
+		{"prometheus needs no server", func(i *InfluxSettings) { i.Listen, i.URL, i.Database = ":9101", "", "" }, ""},
+		{"dry run needs no server", func(i *InfluxSettings) { i.DryRun, i.URL, i.Database = true, "", "" }, ""},
+		{"udp", func(i *InfluxSettings) { i.Protocol, i.URL = "udp", "udp://localhost:8089" }, ""},
+		{"udp with credentials", func(i *InfluxSettings) { i.Protocol, i.Destinations[0].User = "udp", "admin" }, "can't be used with the udp protocol"},
+		{"udp to v2", func(i *InfluxSettings) {
+			i.Protocol, i.InfluxVersion, i.Org, i.Bucket, i.Token = "udp", 2, "o", "b", "t"
+		}, "only supported for InfluxDB 1.x"},
+		{"unknown protocol", func(i *InfluxSettings) { i.Protocol = "tcp" }, "protocol 'tcp' is invalid"},
+		{"frag-order below -1", func(i *InfluxSettings) { i.FragOrder = -2 }, "frag-order -2"},
+		{"frag-order too high", func(i *InfluxSettings) { i.FragOrder = maxPageOrder + 1 }, "frag-order 21"},
+		{"frag-order highest", func(i *InfluxSettings) { i.FragOrder = maxPageOrder }, ""},
+		{"write-path", func(i *InfluxSettings) { i.WritePath = "/relay/write" }, ""},
+		{"write-path over udp", func(i *InfluxSettings) { i.WritePath = "/relay/write"; i.Protocol = "udp" }, "write-path is only supported"},
+		{"write-path with 2.x", func(i *InfluxSettings) { i.WritePath = "/relay/write"; i.InfluxVersion = 2 }, "write-path is only supported"},
+		{"watch-order below -1", func(i *InfluxSettings) { i.WatchOrder = -2 }, "watch-order -2"},
+		{"watch-order too high", func(i *InfluxSettings) { i.WatchOrder = maxPageOrder + 1 }, "watch-order 21"},
+		{"watch-order highest", func(i *InfluxSettings) { i.WatchOrder = maxPageOrder }, ""},
+		{"alert-order below -1", func(i *InfluxSettings) { i.AlertOrder = -2 }, "alert-order -2"},
+		{"alert-order too high", func(i *InfluxSettings) { i.AlertOrder = maxPageOrder + 1 }, "alert-order 21"},
+		{"alert-order highest", func(i *InfluxSettings) { i.AlertOrder = maxPageOrder }, ""},
+		{"min-order negative", func(i *InfluxSettings) { i.MinOrder = -1 }, "min-order -1"},
+		{"min-order too high", func(i *InfluxSettings) { i.MinOrder = maxPageOrder + 1 }, "min-order 21"},
+		{"max-order below -1", func(i *InfluxSettings) { i.MaxOrder = -2 }, "max-order -2"},
+		{"max-order too high", func(i *InfluxSettings) { i.MaxOrder = maxPageOrder + 1 }, "max-order 21"},
+		{"max-order below min-order", func(i *InfluxSettings) { i.MinOrder = 8; i.MaxOrder = 3 }, "max-order 3 is below min-order 8"},
+		{"max-order -1 with min-order", func(i *InfluxSettings) { i.MinOrder = 8; i.MaxOrder = -1 }, ""},
+		{"single order", func(i *InfluxSettings) { i.MinOrder = 8; i.MaxOrder = 8 }, ""},
+		{"several problems", func(i *InfluxSettings) { i.Measurement, i.Destinations[0].Database = "", "" }, "measurement is empty; database for 'http://localhost:8086' is empty"},
+	}
+	for _, tt := range tests {
+		influx := testSettings()
+		tt.change(&influx)
+
+		err := influx.validate()
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s: error = %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestReadTagsFile(t *testing.T) {
+	path := writeTemp(t, "tags", "# rack tags\nrack = r12\n\n  # indented comment\ndc=east\r\n")
+	tags, err := readTagsFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"rack": "r12", "dc": "east"}
+	if !reflect.DeepEqual(tags, want) {
+		t.Errorf("readTagsFile = %v, want %v", tags, want)
+	}
+
+	path = writeTemp(t, "bad", "rack=r12\nrole web\n")
+	if _, err := readTagsFile(path); err == nil || !strings.Contains(err.Error(), ":2: invalid tag 'role web'") {
+		t.Errorf("readTagsFile with a bad line: error = %v", err)
+	}
+}
+
+func TestReadTagsFileIsLocal(t *testing.T) {
+	influx := testSettings()
+	// Reading the tags file over ssh would fail, as there is no such host.
+	influx.SSHHost = "buddymon-test.invalid"
+	useConfig(t, influx)
+
+	path := writeTemp(t, "tags", "rack=r12\n")
+	tags, err := readTagsFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"rack": "r12"}; !reflect.DeepEqual(tags, want) {
+		t.Errorf("readTagsFile = %v, want %v", tags, want)
+	}
+}
+
+func TestTagsFilePrecedence(t *testing.T) {
+	tagsFile := writeTemp(t, "tags", "rack=r1\ndc=east\n")
+	config := writeTemp(t, "buddymon.yml", "tags:\n  rack: r3\n")
+	tests := []struct {
+		name string
+		args []string
+		want map[string]string
+	}{
+		{"tags file", []string{"--tags-file", tagsFile},
+			map[string]string{"rack": "r1", "dc": "east", "host": "myhost"}},
+		{"-t over tags file", []string{"--tags-file", tagsFile, "-t", "rack=r2,role=web"},
+			map[string]string{"rack": "r2", "dc": "east", "role": "web", "host": "myhost"}},
+		{"config file over tags file", []string{"--tags-file", tagsFile, "--config", config},
+			map[string]string{"rack": "r3", "dc": "east", "host": "myhost"}},
+	}
+	for _, tt := range tests {
+		influx, stderr, err := runGetConfig(t, nil, append(tt.args, "-h", "myhost")...)
+		if err != nil {
+			t.Errorf("%s: %v\n%s", tt.name, err, stderr)
+			continue
+		}
+		if !reflect.DeepEqual(influx.GlobalTags, tt.want) {
+			t.Errorf("%s: tags %v, want %v", tt.name, influx.GlobalTags, tt.want)
+		}
+	}
+}
+
+func TestCheckTag(t *testing.T) {
+	tests := []struct {
+		key, value string
+		err        string // substring of the error, or empty for none
+	}{
+		{"rack", "r12", ""},
+		{"data center", "us east, 1=a", ""},
+		{"", "r12", "empty key"},
+		{"node", "0", "reserved for the buddyinfo node"},
+		{"zone", "Normal", "reserved for the buddyinfo zone"},
+		{"time", "now", "reserved by InfluxDB"},
+		{"_field", "x", "reserved by InfluxDB"},
+		{"ra\nck", "r12", "control characters"},
+		{"rack", "r\t12", "control characters"},
+		{`rack\`, "r12", "backslash"},
+		{"rack", `r12\`, "backslash"},
+	}
+	for _, tt := range tests {
+		err := checkTag(tt.key, tt.value)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("checkTag(%q, %q): %v", tt.key, tt.value, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("checkTag(%q, %q) error = %v, want %q", tt.key, tt.value, err, tt.err)
+		}
+	}
+}
+
+func TestHostTagCollision(t *testing.T) {
+	influx, stderr, err := runGetConfig(t, nil, "-h", "myhost", "-t", "host=web1")
+	if err != nil {
+		t.Fatalf("%v\n%s", err, stderr)
+	}
+	if got := influx.GlobalTags["host"]; got != "web1" {
+		t.Errorf("host tag %q, want the user's web1", got)
+	}
+	if !strings.Contains(stderr, "Using host tag 'web1' from tags instead of hostname 'myhost'") {
+		t.Errorf("no warning about the host tag collision in:\n%s", stderr)
+	}
+
+	_, stderr, err = runGetConfig(t, nil, "-t", "zone=east")
+	if err == nil || !strings.Contains(stderr, "tag 'zone' is reserved") {
+		t.Errorf("reserved zone tag: error %v, stderr:\n%s", err, stderr)
+	}
+}
+
+func TestHostnameTag(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want map[string]string
+		warn string // substring of a warning, or empty for none
+	}{
+		{"default key", []string{"-h", "myhost"}, map[string]string{"host": "myhost"}, ""},
+		{"custom key", []string{"-h", "myhost", "--hostname-tag", "hostname"},
+			map[string]string{"hostname": "myhost"}, ""},
+		{"custom key with a host tag", []string{"-h", "myhost", "--hostname-tag", "hostname", "-t", "host=web1"},
+			map[string]string{"hostname": "myhost", "host": "web1"}, ""},
+		{"custom key set by a tag", []string{"-h", "myhost", "--hostname-tag", "hostname", "-t", "hostname=web1"},
+			map[string]string{"hostname": "web1"}, "Using hostname tag 'web1' from tags instead of hostname 'myhost'"},
+		{"no hostname", []string{"-H", "--hostname-tag", "hostname"}, map[string]string{}, ""},
+	}
+	for _, tt := range tests {
+		influx, stderr, err := runGetConfig(t, nil, tt.args...)
+		if err != nil {
+			t.Errorf("%s: %v\n%s", tt.name, err, stderr)
+			continue
+		}
+		if !reflect.DeepEqual(influx.GlobalTags, tt.want) {
+			t.Errorf("%s: tags %v, want %v", tt.name, influx.GlobalTags, tt.want)
+		}
+		if tt.warn != "" && !strings.Contains(stderr, tt.warn) {
+			t.Errorf("%s: no warning %q in:\n%s", tt.name, tt.warn, stderr)
+		}
+	}
+
+	_, stderr, err := runGetConfig(t, nil, "--hostname-tag", "zone")
+	if err == nil || !strings.Contains(stderr, "tag 'zone' is reserved") {
+		t.Errorf("reserved hostname tag key: error %v, stderr:\n%s", err, stderr)
+	}
+}
+
+func TestEmptyTagValues(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		err  string // expected in stderr, or empty for success
+	}{
+		{"empty hostname", []string{"-h", ""}, "hostname is unknown, set --hostname or use --no-hostname"},
+		{"empty hostname with a host tag", []string{"-h", "", "-t", "host=web1"}, ""},
+		{"empty hostname without a host tag", []string{"-h", "", "-H"}, ""},
+		{"empty tag value", []string{"-h", "myhost", "-t", "rack="}, "tag 'rack' has an empty value"},
+	}
+	for _, tt := range tests {
+		_, stderr, err := runGetConfig(t, nil, tt.args...)
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("%s: %v\n%s", tt.name, err, stderr)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(stderr, tt.err) {
+			t.Errorf("%s: error %v, want %q in stderr:\n%s", tt.name, err, tt.err, stderr)
+		}
+	}
+
+	path := writeTemp(t, "tags", "rack=\n")
+	if _, stderr, err := runGetConfig(t, nil, "-h", "myhost", "--tags-file", path); err == nil || !strings.Contains(stderr, "tag 'rack' has an empty value") {
+		t.Errorf("empty value in a tags file: error %v, stderr:\n%s", err, stderr)
+	}
+}
+
+func TestTagKernel(t *testing.T) {
+	data, err := ioutil.ReadFile(osreleasePath)
+	if err != nil {
+		t.Skipf("no kernel release to tag with: %v", err)
+	}
+	release := strings.TrimSpace(string(data))
+
+	tests := []struct {
+		name string
+		args []string
+		want map[string]string
+	}{
+		{"off", []string{"-H"}, map[string]string{}},
+		{"on", []string{"-H", "--tag-kernel"}, map[string]string{"kernel": release}},
+		{"set by a tag", []string{"-H", "--tag-kernel", "-t", "kernel=custom"}, map[string]string{"kernel": "custom"}},
+	}
+	for _, tt := range tests {
+		influx, stderr, err := runGetConfig(t, nil, tt.args...)
+		if err != nil {
+			t.Errorf("%s: %v\n%s", tt.name, err, stderr)
+			continue
+		}
+		if !reflect.DeepEqual(influx.GlobalTags, tt.want) {
+			t.Errorf("%s: tags %v, want %v", tt.name, influx.GlobalTags, tt.want)
+		}
+	}
+}
+
+func TestTagArch(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want map[string]string
+	}{
+		{"off", []string{"-H"}, map[string]string{}},
+		{"on", []string{"-H", "--tag-arch"}, map[string]string{"arch": runtime.GOARCH}},
+		{"set by a tag", []string{"-H", "--tag-arch", "-t", "arch=custom"}, map[string]string{"arch": "custom"}},
+	}
+	for _, tt := range tests {
+		influx, stderr, err := runGetConfig(t, nil, tt.args...)
+		if err != nil {
+			t.Errorf("%s: %v\n%s", tt.name, err, stderr)
+			continue
+		}
+		if !reflect.DeepEqual(influx.GlobalTags, tt.want) {
+			t.Errorf("%s: tags %v, want %v", tt.name, influx.GlobalTags, tt.want)
+		}
+	}
+
+	_, stderr, err := runGetConfig(t, nil, "--tag-arch", "--ssh-host", "buddymon-test.invalid")
+	if err == nil || !strings.Contains(stderr, "tag-arch records this machine's architecture") {
+		t.Errorf("tag-arch with ssh-host: error %v, stderr:\n%s", err, stderr)
+	}
+}
+
+func TestPageSizeDefault(t *testing.T) {
+	influx, stderr, err := runGetConfig(t, nil)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, stderr)
+	}
+	if want := int64(syscall.Getpagesize()); influx.PageSize != want {
+		t.Errorf("default page size %d, want this system's %d", influx.PageSize, want)
+	}
+
+	influx, stderr, err = runGetConfig(t, nil, "--page-size", "65536")
+	if err != nil {
+		t.Fatalf("%v\n%s", err, stderr)
+	}
+	if influx.PageSize != 65536 {
+		t.Errorf("page size %d with --page-size 65536", influx.PageSize)
+	}
+}
+
+func TestTagsFromEnvPrefix(t *testing.T) {
+	env := []string{
+		"BUDDYMON_TAG_pod=buddymon-x7k2p",
+		"BUDDYMON_TAG_namespace=monitoring",
+		"BUDDYMON_TAG_k8s_node=worker-3",
+		"BUDDYMON_TAGS=not-a-tag",
+		"OTHER_TAG_rack=r12",
+	}
+	tests := []struct {
+		name string
+		env  []string
+		args []string
+		want map[string]string
+	}{
+		{"no prefix", env, []string{"-H"}, map[string]string{}},
+		{"prefixed variables", env, []string{"-H", "--tags-from-env-prefix", "BUDDYMON_TAG_"},
+			map[string]string{"pod": "buddymon-x7k2p", "namespace": "monitoring", "k8s_node": "worker-3"}},
+		{"-t overrides", env, []string{"-H", "--tags-from-env-prefix", "BUDDYMON_TAG_", "-t", "pod=override"},
+			map[string]string{"pod": "override", "namespace": "monitoring", "k8s_node": "worker-3"}},
+		{"value with equals", []string{"BUDDYMON_TAG_args=a=b"}, []string{"-H", "--tags-from-env-prefix", "BUDDYMON_TAG_"},
+			map[string]string{"args": "a=b"}},
+	}
+	for _, tt := range tests {
+		influx, stderr, err := runGetConfig(t, tt.env, tt.args...)
+		if err != nil {
+			t.Errorf("%s: %v\n%s", tt.name, err, stderr)
+			continue
+		}
+		if !reflect.DeepEqual(influx.GlobalTags, tt.want) {
+			t.Errorf("%s: tags %v, want %v", tt.name, influx.GlobalTags, tt.want)
+		}
+	}
+
+	// The downward API's node name can't become the node tag, which holds
+	// the buddyinfo NUMA node.
+	_, stderr, err := runGetConfig(t, []string{"BUDDYMON_TAG_node=worker-3"}, "--tags-from-env-prefix", "BUDDYMON_TAG_")
+	if err == nil || !strings.Contains(stderr, "tag 'node' is reserved") {
+		t.Errorf("BUDDYMON_TAG_node: error %v, stderr:\n%s", err, stderr)
+	}
+}
+
+func TestPrintConfigRedacts(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(*InfluxSettings)
+		field func(InfluxSettings) string
+	}{
+		{"password", func(i *InfluxSettings) { i.Password = "hunter2" }, func(i InfluxSettings) string { return i.Password }},
+		{"token", func(i *InfluxSettings) { i.Token = "hunter2" }, func(i InfluxSettings) string { return i.Token }},
+		{"auth header", func(i *InfluxSettings) { i.AuthHeader = "Bearer hunter2" }, func(i InfluxSettings) string { return i.AuthHeader }},
+		{"destination password", func(i *InfluxSettings) {
+			i.Destinations = []InfluxDestination{{URL: "http://a:8086", Password: "hunter2"}}
+		}, func(i InfluxSettings) string { return i.Destinations[0].Password }},
+		{"empty password", func(*InfluxSettings) {}, func(i InfluxSettings) string { return i.Password }},
+	}
+	for _, tt := range tests {
+		influx := testSettings()
+		influx.TLSConfig = &tls.Config{ServerName: "influx.example"}
+		tt.setup(&influx)
+		secret := tt.field(influx)
+
+		var out bytes.Buffer
+		if err := printConfig(&out, influx); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if strings.Contains(out.String(), "hunter2") {
+			t.Errorf("%s: printed the secret:\n%s", tt.name, out.String())
+		}
+		if strings.Contains(out.String(), "influx.example") || strings.Contains(out.String(), "TLSConfig") {
+			t.Errorf("%s: printed the TLS config:\n%s", tt.name, out.String())
+		}
+
+		var printed InfluxSettings
+		if err := json.Unmarshal(out.Bytes(), &printed); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		want := redacted
+		if secret == "" {
+			want = ""
+		}
+		if got := tt.field(printed); got != want {
+			t.Errorf("%s: printed %q, want %q", tt.name, got, want)
+		}
+		// The settings in use keep their secrets.
+		if got := tt.field(influx); got != secret {
+			t.Errorf("%s: printing changed the setting to %q", tt.name, got)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// lastRead holds the most recent buddyinfo read for the debug endpoints.
+var lastRead debugSnapshot
+
+type debugSnapshot struct {
+	mu     sync.Mutex
+	raw    []string
+	parsed []BuddyEntry
+}
+
+func (d *debugSnapshot) setRaw(lines []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.raw = lines
+}
+
+func (d *debugSnapshot) setParsed(batch []BuddyEntry) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.parsed = batch
+}
+
+// serveDebug exposes /raw, the buddyinfo text last read, and /parsed, the
+// entries parsed from it as JSON, to help diagnose parsing problems on remote
+// hosts. It only returns if the listener fails.
+func serveDebug(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/raw", func(w http.ResponseWriter, r *http.Request) {
+		lastRead.mu.Lock()
+		defer lastRead.mu.Unlock()
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if len(lastRead.raw) > 0 {
+			w.Write([]byte(strings.Join(lastRead.raw, "\n") + "\n"))
+		}
+	})
+	mux.HandleFunc("/parsed", func(w http.ResponseWriter, r *http.Request) {
+		lastRead.mu.Lock()
+		defer lastRead.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(lastRead.parsed)
+	})
+	logger.Infof("Serving debug endpoints on %s", addr)
+	logger.Errorf("%v", http.ListenAndServe(addr, mux))
+}
@@ -0,0 +1,43 @@
+package main
+
+// lastPoll holds the counter fields of each buddyinfo series from the
+// previous poll, for --emit-deltas.
+var lastPoll = make(map[string]map[string]int64)
+
+// addDeltas adds a <field>_delta field to each buddyinfo entry for each
+// per-order count and byte field, and free_bytes, holding its change since
+// the previous poll. Derived fields such as max_free_order aren't counters,
+// so they get no deltas. Series seen for the first time get no deltas.
+func addDeltas(batch []BuddyEntry, influx InfluxSettings) {
+	for _, entry := range batch {
+		current := make(map[string]int64)
+		for _, name := range deltaFields(influx, len(entry.Orders)) {
+			if value, ok := entry.Pages[name].(int64); ok {
+				current[name] = value
+			}
+		}
+
+		key := seriesKey(entry)
+		prev, ok := lastPoll[key]
+		lastPoll[key] = current
+		if !ok {
+			continue
+		}
+		for name, now := range current {
+			if before, ok := prev[name]; ok {
+				entry.Pages[name+"_delta"] = now - before
+			}
+		}
+	}
+}
+
+// deltaFields returns the names of the fields that get deltas in an entry
+// with the given number of orders, whether or not they were recorded.
+func deltaFields(influx InfluxSettings, orders int) []string {
+	names := []string{influx.FieldPrefix + "free_bytes"}
+	for order := 0; order < orders; order++ {
+		name := influx.FieldPrefix + orderFieldName(influx.FieldNaming, order)
+		names = append(names, name, name+"_bytes")
+	}
+	return names
+}
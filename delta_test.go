@@ -0,0 +1,54 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAddDeltas(t *testing.T) {
+	saved := lastPoll
+	lastPoll = make(map[string]map[string]int64)
+	defer func() { lastPoll = saved }()
+
+	influx := testSettings()
+	influx.FieldUnits = "both"
+	influx.WatchOrder = 1
+	influx.FragOrder = 1
+
+	poll := func(line string) BuddyEntry {
+		entry, err := makeBuddyEntry(line, influx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addDeltas([]BuddyEntry{entry}, influx)
+		return entry
+	}
+
+	first := poll("Node 0, zone Normal 5 2 1")
+	for name := range first.Pages {
+		if strings.HasSuffix(name, "_delta") {
+			t.Errorf("first poll has delta field %s", name)
+		}
+	}
+
+	second := poll("Node 0, zone Normal 3 4 0")
+	want := map[string]int64{
+		"1p_delta":         -2,
+		"2p_delta":         2,
+		"4p_delta":         -1,
+		"1p_bytes_delta":   -2 * 4096,
+		"2p_bytes_delta":   2 * 2 * 4096,
+		"4p_bytes_delta":   -1 * 4 * 4096,
+		"free_bytes_delta": (3 + 8 - 5 - 4 - 4) * 4096,
+	}
+	got := make(map[string]int64)
+	for name, value := range second.Pages {
+		if strings.HasSuffix(name, "_delta") {
+			got[name] = value.(int64)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("deltas = %v, want %v", got, want)
+	}
+}
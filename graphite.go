@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// graphiteEscaper keeps node and zone names from adding path components.
+var graphiteEscaper = strings.NewReplacer(".", "_", " ", "_")
+
+// writeGraphite sends the batch to a Carbon server using the plaintext
+// protocol, one "path value timestamp" line per metric. Buddyinfo entries are
+// written as prefix.node.zone.orderN plus prefix.node.zone.free_bytes, for
+// the orders and free_bytes fields that weren't filtered out; companion
+// collectors are written as prefix.measurement.node.zone.field, with the
+// values of any extra entry tags, such as a migrate type, after the zone.
+// Graphite has no tags, so global tags are not sent.
+func writeGraphite(influx InfluxSettings, batch []BuddyEntry, t time.Time) error {
+	conn, err := net.DialTimeout("tcp", influx.GraphiteAddr, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	out := bufio.NewWriter(conn)
+	ts := t.Unix()
+	for _, entry := range batch {
+		base := []string{influx.GraphitePrefix}
+		if entry.Measurement != "" {
+			base = append(base, graphiteEscaper.Replace(entry.Measurement))
+		}
+		parts := []string{entry.Node, entry.Zone}
+		for _, k := range sortedTagKeys(entry.Tags) {
+			parts = append(parts, entry.Tags[k])
+		}
+		for _, part := range parts {
+			if part != "" {
+				base = append(base, graphiteEscaper.Replace(part))
+			}
+		}
+		prefix := strings.Join(base, ".")
+
+		if entry.Measurement == "" {
+			for order, count := range entry.Orders {
+				if orderRecorded(influx, entry, order) {
+					fmt.Fprintf(out, "%s.order%d %d %d\n", prefix, order, count, ts)
+				}
+			}
+			if freeBytes, ok := entry.Pages[influx.FieldPrefix+"free_bytes"]; ok {
+				fmt.Fprintf(out, "%s.free_bytes %v %d\n", prefix, freeBytes, ts)
+			}
+			continue
+		}
+
+		names := make([]string, 0, len(entry.Pages))
+		for name := range entry.Pages {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(out, "%s.%s %v %d\n", prefix, graphiteEscaper.Replace(name), entry.Pages[name], ts)
+		}
+	}
+	return out.Flush()
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteGraphiteFilteredFields(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			received <- ""
+			return
+		}
+		defer conn.Close()
+		data, _ := ioutil.ReadAll(conn)
+		received <- string(data)
+	}()
+
+	influx := testSettings()
+	influx.GraphiteAddr = ln.Addr().String()
+	influx.GraphitePrefix = "buddyinfo"
+	influx.Fields = []string{"1p", "4p"}
+	useConfig(t, influx)
+	batch, err := parseBuddyInfo(writeTemp(t, "buddyinfo", "Node 0, zone Normal 5 2 1\n"), influx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writeGraphite(influx, batch, time.Unix(100, 0)); err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Split(strings.TrimSpace(<-received), "\n")
+	want := []string{
+		"buddyinfo.0.Normal.order0 5 100",
+		"buddyinfo.0.Normal.order2 1 100",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// cycleHealth tracks the outcome of poll cycles for the /healthz endpoint.
+var cycleHealth healthStatus
+
+type healthStatus struct {
+	mu          sync.Mutex
+	lastSuccess time.Time
+	lastErr     error
+	watching    bool // Polling on file changes, so quiet spells are normal
+}
+
+// record stores the result of a poll cycle.
+func (h *healthStatus) record(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastErr = err
+	if err == nil {
+		h.lastSuccess = clk.Now()
+	}
+}
+
+// setWatching notes whether polls wait for the file to change, as with
+// --watch-file, rather than coming every interval.
+func (h *healthStatus) setWatching(watching bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.watching = watching
+}
+
+func (h *healthStatus) get() (lastSuccess time.Time, watching bool, lastErr error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.lastSuccess, h.watching, h.lastErr
+}
+
+// serveHealth exposes /healthz. It only returns if the listener fails.
+func serveHealth(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", handleHealth)
+	logger.Infof("Serving health checks on %s", addr)
+	logger.Errorf("%v", http.ListenAndServe(addr, mux))
+}
+
+// handleHealth reports 200 if a poll cycle succeeded within the last three
+// intervals, using the interval as currently configured, and 503 otherwise.
+// When watching the file, polls only come when it changes, so instead it
+// reports 200 as long as the last poll succeeded.
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	lastSuccess, watching, lastErr := cycleHealth.get()
+	configMu.RLock()
+	interval := influxConfig.Interval
+	configMu.RUnlock()
+
+	status := http.StatusOK
+	switch {
+	case lastSuccess.IsZero():
+		status = http.StatusServiceUnavailable
+	case watching && lastErr != nil:
+		status = http.StatusServiceUnavailable
+	case !watching && clk.Now().Sub(lastSuccess) > 3*interval:
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+
+	fmt.Fprintln(w, http.StatusText(status))
+	if lastSuccess.IsZero() {
+		fmt.Fprintln(w, "last_success: never")
+	} else {
+		fmt.Fprintln(w, "last_success:", lastSuccess.Format(time.RFC3339))
+	}
+	if lastErr != nil {
+		fmt.Fprintln(w, "last_error:", lastErr)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthz(t *testing.T) {
+	tests := []struct {
+		name     string
+		watching bool
+		since    time.Duration // since the last successful poll
+		lastErr  error
+		status   int
+	}{
+		{"fresh", false, 2 * time.Minute, nil, http.StatusOK},
+		{"stale", false, 4 * time.Minute, nil, http.StatusServiceUnavailable},
+		{"one failure", false, time.Minute, errors.New("boom"), http.StatusOK},
+		{"watching a quiet file", true, time.Hour, nil, http.StatusOK},
+		{"watching after a failure", true, time.Minute, errors.New("boom"), http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		c := useFakeClock(t)
+		influx := testSettings()
+		influx.Interval = time.Minute
+		useConfig(t, influx)
+
+		cycleHealth = healthStatus{}
+		cycleHealth.setWatching(tt.watching)
+		cycleHealth.record(nil)
+		c.Advance(tt.since)
+		if tt.lastErr != nil {
+			cycleHealth.record(tt.lastErr)
+		}
+
+		rec := httptest.NewRecorder()
+		handleHealth(rec, httptest.NewRequest("GET", "/healthz", nil))
+		if rec.Code != tt.status {
+			t.Errorf("%s: status %d, want %d\n%s", tt.name, rec.Code, tt.status, rec.Body)
+		}
+	}
+
+	cycleHealth = healthStatus{}
+	rec := httptest.NewRecorder()
+	handleHealth(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("before any poll: status %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// clientPrecision returns Precision as the 1.x client spells it, which is u
+// rather than us for microseconds. The 2.x API takes Precision as is.
+func (influx InfluxSettings) clientPrecision() string {
+	if influx.Precision == "us" {
+		return "u"
+	}
+	return influx.Precision
+}
+
+// writeV2 posts points as line protocol to the InfluxDB 2.x write API,
+// authenticating with an API token against the configured org and bucket.
+func (ic *influxConn) writeV2(ctx context.Context, points []*client.Point) error {
+	query := url.Values{
+		"org":       {ic.settings.Org},
+		"bucket":    {ic.settings.Bucket},
+		"precision": {ic.settings.Precision},
+	}
+	return ic.post(ctx, "/api/v2/write", query, "Token "+ic.settings.Token, points)
+}
+
+// needsHTTPWriter reports whether InfluxDB 1.x writes need writeV1 rather
+// than the client library, which can't send a custom Authorization header,
+// e.g. for a server behind an auth proxy, connect to a Unix socket or write
+// to an endpoint other than /write, e.g. on a relay.
+func (influx InfluxSettings) needsHTTPWriter() bool {
+	return influx.AuthHeader != "" || influx.WritePath != "" || isUnixURL(influx.URL)
+}
+
+// v1Auth returns the Authorization header for InfluxDB 1.x requests: the
+// --auth-header value, or basic auth with the user and password, if any.
+func (ic *influxConn) v1Auth() string {
+	if ic.settings.AuthHeader != "" {
+		return ic.settings.AuthHeader
+	}
+	if ic.settings.User == "" && ic.settings.Password == "" {
+		return ""
+	}
+	creds := ic.settings.User + ":" + ic.settings.Password
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(creds))
+}
+
+// writeV1 posts points to the InfluxDB 1.x write API without the client
+// library. See needsHTTPWriter.
+func (ic *influxConn) writeV1(ctx context.Context, points []*client.Point) error {
+	query := url.Values{
+		"db":        {ic.settings.Database},
+		"precision": {ic.settings.clientPrecision()},
+	}
+	if ic.settings.RetentionPolicy != "" {
+		query.Set("rp", ic.settings.RetentionPolicy)
+	}
+	if ic.settings.Consistency != "" {
+		query.Set("consistency", ic.settings.Consistency)
+	}
+	endpoint := "/write"
+	if ic.settings.WritePath != "" {
+		endpoint = ic.settings.WritePath
+	}
+	return ic.post(ctx, endpoint, query, ic.v1Auth(), points)
+}
+
+// pingHTTP checks that InfluxDB is up with its /ping endpoint, for servers
+// not written to through the client library, and returns its version.
+func (ic *influxConn) pingHTTP() (string, error) {
+	u, err := ic.baseURL()
+	if err != nil {
+		return "", err
+	}
+	u.Path = path.Join(u.Path, "/ping")
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if ic.settings.InfluxVersion == 2 {
+		req.Header.Set("Authorization", "Token "+ic.settings.Token)
+	} else if auth := ic.v1Auth(); auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+
+	resp, err := ic.httpClient().Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return "", fmt.Errorf("InfluxDB ping failed: %s", resp.Status)
+	}
+	return resp.Header.Get("X-Influxdb-Version"), nil
+}
+
+// httpClient returns the HTTP client for requests not made through the
+// client library, creating it on first use. For a unix:// URL, it connects
+// to the socket at the URL's path.
+func (ic *influxConn) httpClient() *http.Client {
+	if ic.http == nil {
+		transport := &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: ic.settings.TLSConfig,
+		}
+		if u, err := url.Parse(ic.settings.URL); err == nil && u.Scheme == "unix" {
+			var d net.Dialer
+			transport.Proxy = nil
+			transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return d.DialContext(ctx, "unix", u.Path)
+			}
+		}
+		ic.http = &http.Client{
+			Timeout:   ic.settings.WriteTimeout,
+			Transport: transport,
+		}
+	}
+	return ic.http
+}
+
+// baseURL returns the URL that API paths are relative to. Requests over a
+// Unix socket still need an HTTP URL, whose host is ignored.
+func (ic *influxConn) baseURL() (*url.URL, error) {
+	u, err := url.Parse(ic.settings.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "unix" {
+		return &url.URL{Scheme: "http", Host: "localhost"}, nil
+	}
+	return u, nil
+}
+
+// isUnixURL reports whether rawurl is a unix:// socket URL.
+func isUnixURL(rawurl string) bool {
+	return strings.HasPrefix(rawurl, "unix://")
+}
+
+// post sends points as line protocol to an InfluxDB write endpoint, with the
+// given Authorization header if it isn't empty.
+func (ic *influxConn) post(ctx context.Context, endpoint string, query url.Values, auth string, points []*client.Point) error {
+	u, err := ic.baseURL()
+	if err != nil {
+		return err
+	}
+	u.Path = path.Join(u.Path, endpoint)
+	u.RawQuery = query.Encode()
+
+	var body bytes.Buffer
+	var w io.Writer = &body
+	var zw *gzip.Writer
+	if ic.settings.Gzip {
+		zw = gzip.NewWriter(&body)
+		w = zw
+	}
+	for _, pt := range points {
+		io.WriteString(w, pt.PrecisionString(ic.settings.clientPrecision()))
+		io.WriteString(w, "\n")
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodPost, u.String(), &body)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	if ic.settings.Gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+
+	resp, err := ic.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("InfluxDB write failed: %s: %s",
+			resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWritePrecision(t *testing.T) {
+	taken := time.Unix(1500000000, 123456789)
+	tests := []struct {
+		version   int
+		precision string
+		query     string // precision sent to the server
+		stamp     string // timestamp written
+	}{
+		{1, "ns", "ns", "1500000000123456789"},
+		{1, "us", "u", "1500000000123456"},
+		{1, "ms", "ms", "1500000000123"},
+		{1, "s", "s", "1500000000"},
+		{2, "us", "us", "1500000000123456"},
+		{2, "s", "s", "1500000000"},
+	}
+	for _, tt := range tests {
+		server := newFakeInflux(t)
+		influx := server.settings(testSettings())
+		influx.InfluxVersion = tt.version
+		influx.Precision = tt.precision
+		conn := &influxConn{settings: influx}
+
+		batch := []BuddyEntry{{Node: "0", Zone: "Normal", Pages: map[string]interface{}{"1p": int64(1)}}}
+		err := writeBatch(context.Background(), conn, influx, batch, taken)
+		conn.Close()
+		if err != nil {
+			t.Errorf("v%d %s: %v", tt.version, tt.precision, err)
+			continue
+		}
+		if got := server.query().Get("precision"); got != tt.query {
+			t.Errorf("v%d %s: sent precision=%s, want %s", tt.version, tt.precision, got, tt.query)
+		}
+		if lines := server.lines(); len(lines) != 1 || !strings.HasSuffix(lines[0], " "+tt.stamp) {
+			t.Errorf("v%d %s: wrote %q, want time %s", tt.version, tt.precision, lines, tt.stamp)
+		}
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	for _, version := range []int{1, 2} {
+		influx := testSettings()
+		influx.URL = server.URL
+		influx.InfluxVersion = version
+		influx.WriteTimeout = 100 * time.Millisecond
+		conn := &influxConn{settings: influx}
+
+		batch := []BuddyEntry{{Node: "0", Zone: "Normal", Pages: map[string]interface{}{"1p": int64(1)}}}
+		start := time.Now()
+		err := writeBatch(context.Background(), conn, influx, batch, time.Now())
+		elapsed := time.Since(start)
+		conn.Close()
+		if err == nil {
+			t.Errorf("v%d: write to a hung server succeeded", version)
+		}
+		if elapsed > 5*time.Second {
+			t.Errorf("v%d: write gave up after %v, want about %v", version, elapsed, influx.WriteTimeout)
+		}
+	}
+}
+
+func TestAuthHeader(t *testing.T) {
+	tests := []struct {
+		name       string
+		authHeader string
+		user       string
+		password   string
+		want       string
+	}{
+		{"bearer token", "Bearer xyz", "", "", "Bearer xyz"},
+		{"user and password", "", "bob", "secret", "Basic Ym9iOnNlY3JldA=="},
+		{"neither", "", "", "", ""},
+	}
+	for _, tt := range tests {
+		server := newFakeInflux(t)
+		influx := server.settings(testSettings())
+		influx.AuthHeader = tt.authHeader
+		influx.User, influx.Password = tt.user, tt.password
+		influx.RetentionPolicy = "week"
+		influx.Consistency = "all"
+		influx.Precision = "us"
+		conn := &influxConn{settings: influx}
+
+		batch := []BuddyEntry{{Node: "0", Zone: "Normal", Pages: map[string]interface{}{"1p": int64(1)}}}
+		err := writeBatch(context.Background(), conn, influx, batch, time.Unix(1500000000, 123456789))
+		conn.Close()
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := server.authorization(); got != tt.want {
+			t.Errorf("%s: sent Authorization %q, want %q", tt.name, got, tt.want)
+		}
+
+		// Both ways of writing send the same request otherwise.
+		query := server.query()
+		for param, want := range map[string]string{"db": "test", "rp": "week", "consistency": "all", "precision": "u"} {
+			if got := query.Get(param); got != want {
+				t.Errorf("%s: sent %s=%s, want %s", tt.name, param, got, want)
+			}
+		}
+		if lines := server.lines(); len(lines) != 1 || !strings.HasSuffix(lines[0], " 1500000000123456") {
+			t.Errorf("%s: wrote %q, want one point at 1500000000123456", tt.name, lines)
+		}
+	}
+}
+
+func TestConnectInflux(t *testing.T) {
+	var auth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ping" {
+			http.NotFound(w, r)
+			return
+		}
+		auth = r.Header.Get("Authorization")
+		w.Header().Set("X-Influxdb-Version", "1.8.10")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	tests := []struct {
+		name  string
+		setup func(*InfluxSettings)
+		auth  string // Authorization sent with the ping
+		err   bool
+	}{
+		{"1.x", func(*InfluxSettings) {}, "", false},
+		{"1.x with auth header", func(i *InfluxSettings) { i.AuthHeader = "Bearer xyz" }, "Bearer xyz", false},
+		{"2.x", func(i *InfluxSettings) { i.InfluxVersion, i.Token = 2, "secret" }, "Token secret", false},
+		{"unreachable", func(i *InfluxSettings) { i.URL = down.URL }, "", true},
+		{"wrong path", func(i *InfluxSettings) { i.URL = server.URL + "/nowhere"; i.InfluxVersion = 2 }, "", true},
+		{"udp", func(i *InfluxSettings) { i.URL, i.Protocol = "udp://"+down.Listener.Addr().String(), "udp" }, "", false},
+	}
+	for _, tt := range tests {
+		auth = ""
+		influx := testSettings()
+		influx.URL = server.URL
+		influx.WriteTimeout = time.Second
+		tt.setup(&influx)
+		conns := influxConns{{settings: influx}}
+
+		err := connectInflux(conns)
+		conns.Close()
+		if (err != nil) != tt.err {
+			t.Errorf("%s: err = %v, want error %v", tt.name, err, tt.err)
+		}
+		if auth != tt.auth {
+			t.Errorf("%s: sent Authorization %q, want %q", tt.name, auth, tt.auth)
+		}
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	// Socket paths are limited to about 100 bytes, too short for t.TempDir.
+	dir, err := ioutil.TempDir("", "buddymon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "influxdb.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newFakeInflux(t)
+	go http.Serve(ln, server.Config.Handler)
+	defer ln.Close()
+
+	influx := server.settings(testSettings())
+	influx.URL = "unix://" + sock
+	conn := &influxConn{settings: influx}
+	defer conn.Close()
+
+	batch := []BuddyEntry{{Node: "0", Zone: "Normal", Pages: map[string]interface{}{"1p": int64(1)}}}
+	if err := writeBatch(context.Background(), conn, influx, batch, time.Unix(1500000000, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if lines := server.lines(); len(lines) != 1 || !strings.HasPrefix(lines[0], "buddyinfo,") {
+		t.Errorf("wrote %q over the socket, want one buddyinfo point", lines)
+	}
+	if db := server.query().Get("db"); db != influx.Database {
+		t.Errorf("wrote to database %q, want %q", db, influx.Database)
+	}
+	if _, err := conn.ping(); err != nil {
+		t.Errorf("ping: %v", err)
+	}
+}
+
+func TestWritePath(t *testing.T) {
+	var paths, auths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		auths = append(auths, r.Header.Get("Authorization"))
+		if r.URL.Query().Get("db") != "buddyinfo" {
+			http.Error(w, "database not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name      string
+		url       string
+		writePath string
+		user      string
+		path      string // path written to
+		auth      string // Authorization sent
+	}{
+		{"default", server.URL, "", "", "/write", ""},
+		{"relay", server.URL, "/relay/write", "", "/relay/write", ""},
+		{"relay under a base path", server.URL + "/influx", "/relay/write", "", "/influx/relay/write", ""},
+		{"relay with a user", server.URL, "/relay/write", "bob", "/relay/write", "Basic Ym9iOnNlY3JldA=="},
+	}
+	for _, tt := range tests {
+		paths, auths = nil, nil
+		influx := testSettings()
+		influx.URL = tt.url
+		influx.WritePath = tt.writePath
+		if tt.user != "" {
+			influx.User, influx.Password = tt.user, "secret"
+		}
+		conn := &influxConn{settings: influx}
+
+		batch := []BuddyEntry{{Node: "0", Zone: "Normal", Pages: map[string]interface{}{"1p": int64(1)}}}
+		err := writeBatch(context.Background(), conn, influx, batch, time.Unix(1500000000, 0))
+		conn.Close()
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if len(paths) != 1 || paths[0] != tt.path || auths[0] != tt.auth {
+			t.Errorf("%s: wrote to %q with Authorization %q, want %q with %q", tt.name, paths, auths, tt.path, tt.auth)
+		}
+	}
+}
+
+func TestGzipWrites(t *testing.T) {
+	var encodings, bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := r.Header.Get("Content-Encoding")
+		var body []byte
+		var err error
+		if encoding == "gzip" {
+			var zr *gzip.Reader
+			if zr, err = gzip.NewReader(r.Body); err == nil {
+				body, err = ioutil.ReadAll(zr)
+			}
+		} else {
+			body, err = ioutil.ReadAll(r.Body)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		encodings = append(encodings, encoding)
+		bodies = append(bodies, string(body))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name  string
+		setup func(*InfluxSettings)
+	}{
+		{"1.x", func(*InfluxSettings) {}},
+		{"1.x relay", func(i *InfluxSettings) { i.WritePath = "/relay/write" }},
+		{"2.x", func(i *InfluxSettings) { i.InfluxVersion, i.Token, i.Org, i.Bucket = 2, "secret", "org", "bucket" }},
+	}
+	for _, tt := range tests {
+		for _, compress := range []bool{false, true} {
+			encodings, bodies = nil, nil
+			influx := testSettings()
+			influx.URL = server.URL
+			influx.Gzip = compress
+			tt.setup(&influx)
+			conn := &influxConn{settings: influx}
+
+			batch := []BuddyEntry{{Node: "0", Zone: "Normal", Pages: map[string]interface{}{"1p": int64(1)}}}
+			err := writeBatch(context.Background(), conn, influx, batch, time.Unix(1500000000, 0))
+			conn.Close()
+			if err != nil {
+				t.Errorf("%s, gzip %v: %v", tt.name, compress, err)
+				continue
+			}
+			want := ""
+			if compress {
+				want = "gzip"
+			}
+			if len(encodings) != 1 || encodings[0] != want {
+				t.Errorf("%s, gzip %v: sent encodings %q, want %q", tt.name, compress, encodings, want)
+				continue
+			}
+			if !strings.HasPrefix(bodies[0], "buddyinfo,host=testhost,node=0,zone=Normal 1p=1i ") {
+				t.Errorf("%s, gzip %v: wrote %q", tt.name, compress, bodies[0])
+			}
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logLevel orders log messages by severity.
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = map[logLevel]string{
+	levelDebug: "debug",
+	levelInfo:  "info",
+	levelWarn:  "warn",
+	levelError: "error",
+}
+
+// parseLogLevel converts a --log-level name to a logLevel.
+func parseLogLevel(name string) (logLevel, error) {
+	for level, n := range levelNames {
+		if strings.EqualFold(name, n) {
+			return level, nil
+		}
+	}
+	return levelInfo, fmt.Errorf("unknown log level '%s'", name)
+}
+
+// leveledLogger drops messages below its level and writes the rest either
+// as human-readable text via the standard logger, or as JSON lines.
+type leveledLogger struct {
+	mu    sync.Mutex
+	level logLevel
+	json  bool
+}
+
+var logger = &leveledLogger{level: levelInfo}
+
+func (l *leveledLogger) Debugf(format string, args ...interface{}) {
+	l.logf(levelDebug, format, args...)
+}
+
+func (l *leveledLogger) Infof(format string, args ...interface{}) {
+	l.logf(levelInfo, format, args...)
+}
+
+func (l *leveledLogger) Warnf(format string, args ...interface{}) {
+	l.logf(levelWarn, format, args...)
+}
+
+func (l *leveledLogger) Errorf(format string, args ...interface{}) {
+	l.logf(levelError, format, args...)
+}
+
+func (l *leveledLogger) logf(level logLevel, format string, args ...interface{}) {
+	if level < l.level {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+
+	if !l.json {
+		// Info messages are unprefixed, as they were before levels existed.
+		switch level {
+		case levelDebug:
+			msg = "DEBUG: " + msg
+		case levelWarn:
+			msg = "WARNING: " + msg
+		case levelError:
+			msg = "ERROR: " + msg
+		}
+		log.Println(msg)
+		return
+	}
+
+	line, err := json.Marshal(struct {
+		Time  string `json:"time"`
+		Level string `json:"level"`
+		Msg   string `json:"msg"`
+	}{time.Now().Format(time.RFC3339Nano), levelNames[level], msg})
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	os.Stderr.Write(append(line, '\n'))
+}
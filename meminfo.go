@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const defaultMeminfoPath = "/proc/meminfo"
+
+/*
+Meminfo sample, trimmed. Sizes are in kB except for the HugePages_ counts.
+
+> cat /proc/meminfo
+MemTotal:       16316412 kB
+MemFree:          450156 kB
+MemAvailable:    9877432 kB
+Buffers:          731364 kB
+Cached:          8562632 kB
+...
+*/
+
+// meminfoFields are the /proc/meminfo lines recorded, for overall memory
+// pressure alongside fragmentation.
+var meminfoFields = map[string]bool{
+	"MemTotal":     true,
+	"MemFree":      true,
+	"MemAvailable": true,
+	"Buffers":      true,
+	"Cached":       true,
+	"SwapTotal":    true,
+	"SwapFree":     true,
+	"Committed_AS": true,
+}
+
+// parseMemInfo reads the system-wide memory counters from a meminfo file into
+// a single entry with the given measurement name. Values are converted from
+// kB to bytes, and fields keep the kernel's names.
+func parseMemInfo(path, measurement string, influx InfluxSettings) (BuddyEntry, error) {
+	entry := BuddyEntry{
+		Pages:       make(map[string]interface{}),
+		Measurement: measurement,
+	}
+
+	lines, err := slurpLines(path, influx)
+	if err != nil {
+		return entry, err
+	}
+
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		name := strings.TrimSuffix(fields[0], ":")
+		if !meminfoFields[name] {
+			continue
+		}
+		i, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return entry, fmt.Errorf("invalid %s value %q in %v", name, fields[1], line)
+		}
+		if len(fields) > 2 && fields[2] == "kB" {
+			i *= 1024
+		}
+		entry.Pages[name] = i
+	}
+	if len(entry.Pages) == 0 {
+		return entry, fmt.Errorf("%s: no memory counters found", path)
+	}
+	return entry, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tsdbPoint is a datapoint in the OpenTSDB /api/put JSON format.
+type tsdbPoint struct {
+	Metric    string            `json:"metric"`
+	Timestamp int64             `json:"timestamp"`
+	Value     interface{}       `json:"value"`
+	Tags      map[string]string `json:"tags"`
+}
+
+var tsdbClient = &http.Client{Timeout: 10 * time.Second}
+
+// writeOpenTSDB posts the batch to OpenTSDB's /api/put in a single request.
+// Each order's free block count becomes a <measurement>.freepages datapoint
+// tagged with order, node, zone and the global tags, unless --fields or the
+// order range dropped its field. Other fields, and those of companion
+// collectors, become <measurement>.<field> datapoints.
+func writeOpenTSDB(influx InfluxSettings, batch []BuddyEntry, t time.Time) error {
+	var points []tsdbPoint
+	for _, entry := range batch {
+		tags := pointTags(influx, entry.Node, entry.Zone)
+
+		if entry.Measurement != "" {
+			for k, v := range entry.Tags {
+				tags[k] = v
+			}
+			for name, value := range entry.Pages {
+				points = append(points, tsdbPoint{entry.Measurement + "." + name, t.Unix(), value, tags})
+			}
+			continue
+		}
+
+		for order, count := range entry.Orders {
+			if !orderRecorded(influx, entry, order) {
+				continue
+			}
+			orderTags := pointTags(influx, entry.Node, entry.Zone)
+			orderTags["order"] = strconv.Itoa(order)
+			points = append(points, tsdbPoint{influx.Measurement + ".freepages", t.Unix(), count, orderTags})
+		}
+		if freeBytes, ok := entry.Pages[influx.FieldPrefix+"free_bytes"]; ok {
+			points = append(points, tsdbPoint{influx.Measurement + ".free_bytes", t.Unix(), freeBytes, tags})
+		}
+	}
+
+	body, err := json.Marshal(points)
+	if err != nil {
+		return err
+	}
+	u, err := url.Parse(influx.OpenTSDBURL)
+	if err != nil {
+		return err
+	}
+	u.Path = path.Join(u.Path, "/api/put")
+
+	resp, err := tsdbClient.Post(u.String(), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("OpenTSDB put failed: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
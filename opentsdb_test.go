@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWriteOpenTSDBFilteredFields(t *testing.T) {
+	var points []tsdbPoint
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&points); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	influx := testSettings()
+	influx.OpenTSDBURL = server.URL
+	influx.MinOrder = 1
+	entry, err := makeBuddyEntry("Node 0, zone Normal 5 2 1", influx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(entry.Pages, "free_bytes") // as if --fields left it out
+
+	if err := writeOpenTSDB(influx, []BuddyEntry{entry}, time.Unix(100, 0)); err != nil {
+		t.Fatal(err)
+	}
+	var orders []string
+	for _, p := range points {
+		if p.Value == nil {
+			t.Errorf("%s has no value", p.Metric)
+		}
+		if p.Metric == "buddyinfo.free_bytes" {
+			t.Errorf("sent filtered out free_bytes")
+		}
+		if p.Metric == "buddyinfo.freepages" {
+			orders = append(orders, p.Tags["order"])
+		}
+	}
+	if len(orders) != 2 || orders[0] != "1" || orders[1] != "2" {
+		t.Errorf("sent freepages for orders %v, want [1 2]", orders)
+	}
+}
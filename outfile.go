@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"time"
+)
+
+// writeFile appends the batch as line protocol to influx.OutputFile, for
+// shipping to InfluxDB later from hosts that can't reach it. When the file
+// would grow past OutputFileMaxBytes it is rotated first, keeping up to
+// OutputFileKeep older files named with a .1, .2, ... suffix, newest first.
+func writeFile(influx InfluxSettings, batch []BuddyEntry, t time.Time) error {
+	var buf bytes.Buffer
+	if err := writeLineProtocol(&buf, influx, batch, t); err != nil {
+		return err
+	}
+
+	if influx.OutputFileMaxBytes > 0 {
+		fi, err := os.Stat(influx.OutputFile)
+		if err == nil && fi.Size() > 0 && fi.Size()+int64(buf.Len()) > influx.OutputFileMaxBytes {
+			if err := rotateFile(influx.OutputFile, influx.OutputFileKeep); err != nil {
+				return err
+			}
+		}
+	}
+
+	f, err := os.OpenFile(influx.OutputFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// rotateFile shifts path to path.1, path.1 to path.2 and so on, dropping the
+// file that would become path.(keep+1).
+func rotateFile(path string, keep int) error {
+	oldest := fmt.Sprintf("%s.%d", path, keep)
+	if keep == 0 {
+		oldest = path
+	}
+	if err := os.Remove(oldest); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for i := keep - 1; i >= 0; i-- {
+		from := fmt.Sprintf("%s.%d", path, i)
+		if i == 0 {
+			from = path
+		}
+		if err := os.Rename(from, fmt.Sprintf("%s.%d", path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
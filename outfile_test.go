@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteFile(t *testing.T) {
+	batch := []BuddyEntry{{Node: "0", Zone: "Normal", Pages: map[string]interface{}{"1p": int64(1)}}}
+	var line bytes.Buffer
+	if err := writeLineProtocol(&line, testSettings(), batch, time.Unix(0, 1)); err != nil {
+		t.Fatal(err)
+	}
+	lineBytes := int64(line.Len())
+
+	tests := []struct {
+		name     string
+		maxBytes int64
+		keep     int
+		want     map[string][]int64 // file suffix to timestamps, newest file first
+	}{
+		{"append", 0, 0, map[string][]int64{"": {1, 2, 3, 4}}},
+		{"rotate every write", 1, 2, map[string][]int64{"": {4}, ".1": {3}, ".2": {2}}},
+		{"rotate every other write", 2 * lineBytes, 1, map[string][]int64{"": {3, 4}, ".1": {1, 2}}},
+		{"keep none", 1, 0, map[string][]int64{"": {4}}},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		influx := testSettings()
+		influx.OutputFile = filepath.Join(dir, "buddyinfo.lp")
+		influx.OutputFileMaxBytes = tt.maxBytes
+		influx.OutputFileKeep = tt.keep
+		for i := int64(1); i <= 4; i++ {
+			if err := writeFile(influx, batch, time.Unix(0, i)); err != nil {
+				t.Fatalf("%s: write %d: %v", tt.name, i, err)
+			}
+		}
+
+		got := map[string][]int64{}
+		files, _ := ioutil.ReadDir(dir)
+		for _, fi := range files {
+			data, err := ioutil.ReadFile(filepath.Join(dir, fi.Name()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			suffix := strings.TrimPrefix(fi.Name(), "buddyinfo.lp")
+			for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+				ts, err := strconv.ParseInt(line[strings.LastIndex(line, " ")+1:], 10, 64)
+				if err != nil {
+					t.Fatalf("%s: bad line %q in %s", tt.name, line, fi.Name())
+				}
+				got[suffix] = append(got[suffix], ts)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: files hold %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestWriteFileError(t *testing.T) {
+	influx := testSettings()
+	influx.OutputFile = filepath.Join(t.TempDir(), "missing", "buddyinfo.lp")
+	batch := []BuddyEntry{{Node: "0", Zone: "Normal", Pages: map[string]interface{}{"1p": int64(1)}}}
+	if err := writeFile(influx, batch, time.Unix(1, 0)); !os.IsNotExist(err) {
+		t.Errorf("writing under a missing directory returned %v, want a not-exist error", err)
+	}
+}
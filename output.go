@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// writeLineProtocol serializes the batch as InfluxDB line protocol, one point
+// per line, e.g. for piping into telegraf. Escaping of spaces, commas and
+// equals signs in tags and fields is handled by the InfluxDB client.
+func writeLineProtocol(w io.Writer, influx InfluxSettings, batch []BuddyEntry, t time.Time) error {
+	points, err := makePoints(influx, batch, t)
+	if err != nil {
+		return err
+	}
+
+	out := bufio.NewWriter(w)
+	for _, pt := range points {
+		out.WriteString(pt.String())
+		out.WriteByte('\n')
+	}
+	return out.Flush()
+}
+
+// printDryRun shows the points that would be written for the batch, without
+// contacting InfluxDB.
+func printDryRun(w io.Writer, influx InfluxSettings, batch []BuddyEntry, t time.Time) error {
+	points, err := makePoints(influx, batch, t)
+	if err != nil {
+		return err
+	}
+
+	for _, pt := range points {
+		fields, err := pt.Fields()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "DRY RUN: measurement=%s tags=%v fields=%v time=%s\n",
+			pt.Name(), pt.Tags(), fields, pt.Time().Format(time.RFC3339Nano))
+	}
+	return nil
+}
+
+// jsonSnapshot is the --output json form of a batch. It is a stable format
+// for other tools to consume, so change it with care.
+type jsonSnapshot struct {
+	Time    time.Time         `json:"time"`
+	Tags    map[string]string `json:"tags"`
+	Entries []jsonEntry       `json:"entries"`
+}
+
+type jsonEntry struct {
+	Measurement string                 `json:"measurement"`
+	Node        string                 `json:"node,omitempty"`
+	Zone        string                 `json:"zone,omitempty"`
+	Tags        map[string]string      `json:"tags,omitempty"`
+	Fields      map[string]interface{} `json:"fields"`
+}
+
+// writeJSON writes the batch as a single line of JSON (NDJSON), with the
+// global tags and poll time.
+func writeJSON(w io.Writer, influx InfluxSettings, batch []BuddyEntry, t time.Time) error {
+	snap := jsonSnapshot{Time: t, Tags: influx.GlobalTags, Entries: make([]jsonEntry, 0, len(batch))}
+	for _, entry := range batch {
+		measurement := influx.Measurement
+		if entry.Measurement != "" {
+			measurement = entry.Measurement
+		}
+		snap.Entries = append(snap.Entries, jsonEntry{
+			Measurement: measurement,
+			Node:        entry.Node,
+			Zone:        entry.Zone,
+			Tags:        entry.Tags,
+			Fields:      entry.Pages,
+		})
+	}
+	return json.NewEncoder(w).Encode(snap)
+}
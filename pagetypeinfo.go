@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const defaultPagetypeinfoPath = "/proc/pagetypeinfo"
+
+/*
+Pagetypeinfo sample, trimmed. It splits buddyinfo's free block counts by
+migrate type, then counts pageblocks of each type. It is only readable by root.
+
+> cat /proc/pagetypeinfo
+Page block order: 9
+Pages per block:  512
+
+Free pages count per migrate type at order       0      1      2 ...     10
+Node    0, zone      DMA, type    Unmovable      0      0      0 ...      0
+Node    0, zone      DMA, type      Movable      0      0      0 ...      3
+...
+
+Number of blocks type     Unmovable      Movable  Reclaimable   HighAtomic      Isolate
+Node 0, zone      DMA            1            7            0            0            0
+*/
+
+// parsePagetypeInfo reads the free block counts per order of each migrate
+// type in each zone from a pagetypeinfo file, plus the number of pageblocks
+// of that type as a blocks field. Entries carry the given measurement name
+// and a migratetype tag alongside node and zone.
+func parsePagetypeInfo(path, measurement string, influx InfluxSettings) ([]BuddyEntry, error) {
+	lines, err := slurpLines(path, influx)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []BuddyEntry
+	var blockTypes []string
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) > 6 && fields[0] == "Node" && fields[4] == "type":
+			entry := BuddyEntry{
+				Node:        strings.Trim(fields[1], ","),
+				Zone:        strings.Trim(fields[3], ","),
+				Tags:        map[string]string{"migratetype": fields[5]},
+				Pages:       make(map[string]interface{}),
+				Measurement: measurement,
+			}
+			for order, p := range fields[6:] {
+				name := fmt.Sprintf("%dp", 1<<uint(order))
+				if influx.FieldNaming == "order" {
+					name = fmt.Sprintf("order%d", order)
+				}
+				i, err := strconv.ParseInt(p, 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("invalid page count %q for %s in %v", p, name, line)
+				}
+				entry.Pages[name] = i
+			}
+			entries = append(entries, entry)
+
+		case len(fields) > 4 && strings.HasPrefix(line, "Number of blocks type"):
+			blockTypes = fields[4:]
+
+		case len(fields) == 4+len(blockTypes) && len(blockTypes) > 0 && fields[0] == "Node":
+			node, zone := strings.Trim(fields[1], ","), strings.Trim(fields[3], ",")
+			for t, count := range fields[4:] {
+				i, err := strconv.ParseInt(count, 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("invalid block count %q for %s in %v", count, blockTypes[t], line)
+				}
+				for _, entry := range entries {
+					if entry.Node == node && entry.Zone == zone && entry.Tags["migratetype"] == blockTypes[t] {
+						entry.Pages["blocks"] = i
+					}
+				}
+			}
+		}
+	}
+
+	// Apply the same node and zone filters as buddyinfo.
+	var filtered []BuddyEntry
+	for _, entry := range entries {
+		if !allowed(influx.Nodes, entry.Node) || !zoneAllowed(influx, entry.Zone) {
+			continue
+		}
+		filtered = append(filtered, entry)
+	}
+	return filtered, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// promBatch holds the most recent batch for the Prometheus exporter.
+var promBatch latestBatch
+
+// latestBatch guards a batch shared between the poll loop and HTTP handlers.
+type latestBatch struct {
+	mu    sync.RWMutex
+	batch []BuddyEntry
+}
+
+func (l *latestBatch) set(batch []BuddyEntry) {
+	l.mu.Lock()
+	l.batch = batch
+	l.mu.Unlock()
+}
+
+func (l *latestBatch) get() []BuddyEntry {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.batch
+}
+
+// servePrometheus exposes the latest batch on /metrics in the Prometheus text
+// exposition format. It only returns if the listener fails.
+func servePrometheus(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", handleMetrics)
+	logger.Infof("Serving Prometheus metrics on %s", addr)
+	logger.Errorf("%v", http.ListenAndServe(addr, mux))
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	batch := promBatch.get()
+	configMu.RLock()
+	influx := influxConfig
+	configMu.RUnlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	out := bufio.NewWriter(w)
+	defer out.Flush()
+
+	fmt.Fprintln(out, "# HELP buddyinfo_free_pages Free blocks of each page order, from buddyinfo.")
+	fmt.Fprintln(out, "# TYPE buddyinfo_free_pages gauge")
+	for _, entry := range batch {
+		for order, count := range entry.Orders {
+			if !orderRecorded(influx, entry, order) {
+				continue
+			}
+			fmt.Fprintf(out, "buddyinfo_free_pages{node=\"%s\",zone=\"%s\",order=\"%d\"} %d\n",
+				promEscape(entry.Node), promEscape(entry.Zone), order, count)
+		}
+	}
+
+	fmt.Fprintln(out, "# HELP buddyinfo_free_bytes Total free memory in the zone, in bytes.")
+	fmt.Fprintln(out, "# TYPE buddyinfo_free_bytes gauge")
+	for _, entry := range batch {
+		if freeBytes, ok := entry.Pages[influx.FieldPrefix+"free_bytes"]; ok {
+			fmt.Fprintf(out, "buddyinfo_free_bytes{node=\"%s\",zone=\"%s\"} %v\n",
+				promEscape(entry.Node), promEscape(entry.Zone), freeBytes)
+		}
+	}
+
+	fmt.Fprintln(out, "# HELP buddyinfo_parse_errors_total Buddyinfo lines skipped because they failed to parse.")
+	fmt.Fprintln(out, "# TYPE buddyinfo_parse_errors_total counter")
+	fmt.Fprintf(out, "buddyinfo_parse_errors_total %d\n", atomic.LoadUint64(&parseErrors))
+}
+
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// promEscape escapes a label value for the text exposition format.
+func promEscape(s string) string {
+	return promEscaper.Replace(s)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandleMetricsFilteredFields(t *testing.T) {
+	tests := []struct {
+		name   string
+		units  string
+		min    int
+		fields []string
+		orders []string
+	}{
+		{"pages", "pages", 0, nil, []string{"0", "1", "2"}},
+		{"bytes", "bytes", 0, nil, []string{"0", "1", "2"}},
+		{"both", "both", 0, nil, []string{"0", "1", "2"}},
+		{"order range", "bytes", 1, nil, []string{"1", "2"}},
+		{"fields", "pages", 0, []string{"1p", "4p", "free_bytes"}, []string{"0", "2"}},
+		{"fields in bytes", "bytes", 0, []string{"2p_bytes"}, []string{"1"}},
+	}
+	for _, tt := range tests {
+		influx := testSettings()
+		influx.FieldUnits = tt.units
+		influx.MinOrder = tt.min
+		influx.Fields = tt.fields
+		useConfig(t, influx)
+		batch, err := parseBuddyInfo(writeTemp(t, "buddyinfo", "Node 0, zone Normal 5 2 1\n"), influx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		promBatch.set(batch)
+
+		rec := httptest.NewRecorder()
+		handleMetrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+		body, _ := ioutil.ReadAll(rec.Body)
+		var orders []string
+		for _, line := range strings.Split(string(body), "\n") {
+			if strings.HasPrefix(line, "buddyinfo_free_pages{") {
+				i := strings.Index(line, `order="`) + len(`order="`)
+				orders = append(orders, line[i:i+strings.Index(line[i:], `"`)])
+			}
+		}
+		if strings.Join(orders, ",") != strings.Join(tt.orders, ",") {
+			t.Errorf("%s: free_pages for orders %v, want %v", tt.name, orders, tt.orders)
+		}
+		wantFree := tt.fields == nil || strings.Contains(strings.Join(tt.fields, ","), "free_bytes")
+		if got := strings.Contains(string(body), "buddyinfo_free_bytes{"); got != wantFree {
+			t.Errorf("%s: free_bytes sent = %v, want %v", tt.name, got, wantFree)
+		}
+	}
+	promBatch.set(nil)
+}
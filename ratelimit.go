@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// rateLimiter paces writes to a steady number of points per second, so a
+// replay or backfill doesn't overwhelm InfluxDB. Each write is delayed until
+// the points before it have been paid for at the configured rate.
+type rateLimiter struct {
+	next time.Time // When the next write may start
+}
+
+// wait blocks until n points may be written at rate points per second, or
+// ctx is cancelled. A rate of 0 or less is unlimited.
+func (l *rateLimiter) wait(ctx context.Context, rate float64, n int) error {
+	if rate <= 0 {
+		return nil
+	}
+	now := clk.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(float64(n) / rate * float64(time.Second)))
+
+	if delay <= 0 {
+		return nil
+	}
+	select {
+	case <-clk.After(delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterPaces(t *testing.T) {
+	tests := []struct {
+		rate    float64
+		writes  int
+		points  int
+		elapsed time.Duration // until the last write may start
+	}{
+		{rate: 0, writes: 10, points: 1000, elapsed: 0},
+		{rate: 100, writes: 1, points: 500, elapsed: 0},
+		{rate: 100, writes: 10, points: 20, elapsed: 1800 * time.Millisecond},
+		{rate: 1000, writes: 5, points: 1000, elapsed: 4 * time.Second},
+	}
+	for _, tt := range tests {
+		c := useFakeClock(t)
+		start := c.Now()
+		var l rateLimiter
+		for i := 0; i < tt.writes; i++ {
+			if err := l.wait(context.Background(), tt.rate, tt.points); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := c.Now().Sub(start); got != tt.elapsed {
+			t.Errorf("%d writes of %d points at %v/s took %v, want %v",
+				tt.writes, tt.points, tt.rate, got, tt.elapsed)
+		}
+	}
+}
+
+func TestRateLimiterIdleCredit(t *testing.T) {
+	// Time spent idle isn't saved up for a later burst.
+	c := useFakeClock(t)
+	var l rateLimiter
+	l.wait(context.Background(), 10, 10)
+	c.Advance(time.Hour)
+	start := c.Now()
+	for i := 0; i < 3; i++ {
+		l.wait(context.Background(), 10, 10)
+	}
+	if got := c.Now().Sub(start); got != 2*time.Second {
+		t.Errorf("3 writes of 10 points at 10/s after an idle hour took %v, want 2s", got)
+	}
+}
+
+func TestRateLimiterCancel(t *testing.T) {
+	var l rateLimiter
+	l.wait(context.Background(), 1, 3600)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := l.wait(ctx, 1, 1); err != context.DeadlineExceeded {
+		t.Errorf("waiting an hour with a 50ms deadline returned %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestMaxWriteRate(t *testing.T) {
+	batch := []BuddyEntry{
+		{Node: "0", Zone: "DMA32", Pages: map[string]interface{}{"1p": int64(1)}},
+		{Node: "0", Zone: "Normal", Pages: map[string]interface{}{"1p": int64(2)}},
+		{Node: "1", Zone: "DMA32", Pages: map[string]interface{}{"1p": int64(3)}},
+		{Node: "1", Zone: "Normal", Pages: map[string]interface{}{"1p": int64(4)}},
+	}
+	tests := []struct {
+		rate      float64
+		batchSize int
+		elapsed   time.Duration // until the last request may start
+	}{
+		{rate: 0, batchSize: 2, elapsed: 0},
+		// Three batches of four points is 12 points; the last request waits
+		// for the 10 before it.
+		{rate: 2, batchSize: 2, elapsed: 5 * time.Second},
+		{rate: 4, batchSize: 0, elapsed: 2 * time.Second},
+		{rate: 1000, batchSize: 1, elapsed: 11 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		c := useFakeClock(t)
+		server := newFakeInflux(t)
+		influx := server.settings(testSettings())
+		influx.MaxWriteRate = tt.rate
+		influx.BatchSize = tt.batchSize
+		useConfig(t, influx)
+		conns := newInfluxConns(influx)
+
+		// The limiter paces a connection across batches, as in a backfill.
+		start := c.Now()
+		for i := 0; i < 3; i++ {
+			if _, err := updateInflux(context.Background(), conns, influx, batch, start); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := c.Now().Sub(start); got != tt.elapsed {
+			t.Errorf("rate %v, batch size %d: took %v, want %v", tt.rate, tt.batchSize, got, tt.elapsed)
+		}
+		if got := len(server.lines()); got != 3*len(batch) {
+			t.Errorf("rate %v, batch size %d: wrote %d points, want %d", tt.rate, tt.batchSize, got, 3*len(batch))
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// readRemote reads a file on the --ssh-host by running cat over ssh, so one
+// buddymon can poll machines that can't run it themselves. It uses the
+// system ssh client, so ~/.ssh/config and the agent apply as usual.
+func readRemote(influx InfluxSettings, path string) ([]byte, error) {
+	args := []string{"-o", "BatchMode=yes", "-o", "ConnectTimeout=10"}
+	if influx.SSHKey != "" {
+		args = append(args, "-i", influx.SSHKey)
+	}
+	args = append(args, influx.SSHHost, "cat", shellQuote(path))
+
+	var stderr bytes.Buffer
+	cmd := exec.Command("ssh", args...)
+	cmd.Stderr = &stderr
+	data, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("reading %s on %s: %v: %s", path, influx.SSHHost, err, strings.TrimSpace(stderr.String()))
+	}
+	return data, nil
+}
+
+// shellQuote quotes s for the remote shell that ssh runs commands with.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
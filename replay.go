@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// snapshotTimeFormats are the timestamp forms recognized in snapshot file
+// names, e.g. buddyinfo-20231011T120000.txt.gz. Zoneless times are local.
+var snapshotTimeFormats = []struct {
+	re     *regexp.Regexp
+	layout string
+}{
+	{regexp.MustCompile(`\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(Z|[+-]\d{2}:\d{2})`), time.RFC3339},
+	{regexp.MustCompile(`\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}`), "2006-01-02T15:04:05"},
+	{regexp.MustCompile(`\d{8}T\d{6}`), "20060102T150405"},
+	{regexp.MustCompile(`\d{8}-\d{6}`), "20060102-150405"},
+}
+
+// unixTimeName matches a 10-digit Unix timestamp in a file name.
+var unixTimeName = regexp.MustCompile(`(?:^|\D)(\d{10})(?:\D|$)`)
+
+// replaySnapshots writes every buddyinfo snapshot in dir, in name order, each
+// as a batch stamped with the time the snapshot was taken.
+func replaySnapshots(ctx context.Context, conns influxConns, dir string) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, fi := range files {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		path := filepath.Join(dir, fi.Name())
+		t := snapshotTime(fi.Name(), fi.ModTime())
+
+		batch, err := parseBuddyInfo(path, influxConfig)
+		if err != nil {
+			return err
+		}
+		if _, err := emitBatch(ctx, conns, influxConfig, batch, t); err != nil {
+			return err
+		}
+		logger.Infof("Replayed %s at %s", path, t.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// snapshotTime derives a snapshot's time from its file name, falling back
+// to the file modification time.
+func snapshotTime(name string, mtime time.Time) time.Time {
+	for _, f := range snapshotTimeFormats {
+		if m := f.re.FindString(name); m != "" {
+			if t, err := time.ParseInLocation(f.layout, m, time.Local); err == nil {
+				return t
+			}
+		}
+	}
+	if m := unixTimeName.FindStringSubmatch(name); m != nil {
+		if secs, err := strconv.ParseInt(m[1], 10, 64); err == nil {
+			return time.Unix(secs, 0)
+		}
+	}
+	return mtime
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const internalMeasurement = "buddymon_internal"
+
+// Counters reported by --self-metrics. parseErrors is kept by parseBuddyInfo.
+var (
+	startTime   = time.Now()
+	pollCount   uint64
+	writeErrors uint64
+)
+
+// internalEntry reports buddymon's own health, so dashboards can tell an idle
+// zone from a dead agent. It has no node or zone; write_errors counts failed
+// cycles before this one.
+func internalEntry() BuddyEntry {
+	return BuddyEntry{
+		Measurement: internalMeasurement,
+		Pages: map[string]interface{}{
+			"poll_count":     int64(atomic.LoadUint64(&pollCount)),
+			"uptime_seconds": int64(time.Since(startTime).Seconds()),
+			"write_errors":   int64(atomic.LoadUint64(&writeErrors)),
+			"parse_errors":   int64(atomic.LoadUint64(&parseErrors)),
+		},
+	}
+}
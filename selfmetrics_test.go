@@ -0,0 +1,57 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestInternalPointTags(t *testing.T) {
+	tests := []struct {
+		name        string
+		lean        bool
+		hostnameTag string
+		useHostname bool
+		want        map[string]string
+	}{
+		{"all global tags", false, "host", true,
+			map[string]string{"host": "testhost", "rack": "r12", "dc": "east"}},
+		{"host only", true, "host", true,
+			map[string]string{"host": "testhost"}},
+		{"renamed host tag", true, "hostname", true,
+			map[string]string{"hostname": "testhost"}},
+		{"no hostname", true, "host", false,
+			map[string]string{}},
+	}
+	for _, tt := range tests {
+		influx := testSettings()
+		influx.NoGlobalTagsOnInternal = tt.lean
+		influx.HostnameTag = tt.hostnameTag
+		influx.UseHostname = tt.useHostname
+		influx.GlobalTags = map[string]string{"rack": "r12", "dc": "east"}
+		if tt.useHostname {
+			influx.GlobalTags[tt.hostnameTag] = "testhost"
+		}
+
+		batch := []BuddyEntry{
+			{Node: "0", Zone: "Normal", Pages: map[string]interface{}{"1p": int64(1)}},
+			internalEntry(),
+		}
+		points, err := makePoints(influx, batch, time.Unix(100, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := points[1].Tags(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: internal tags %v, want %v", tt.name, got, tt.want)
+		}
+
+		// buddyinfo points always keep every global tag.
+		want := map[string]string{"node": "0", "zone": "Normal"}
+		for k, v := range influx.GlobalTags {
+			want[k] = v
+		}
+		if got := points[0].Tags(); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: buddyinfo tags %v, want %v", tt.name, got, want)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const spoolSuffix = ".json"
+
+// spooledBatch is the on-disk form of a batch that failed to write.
+type spooledBatch struct {
+	Time  time.Time
+	Batch []spooledEntry
+}
+
+// spooledEntry is a BuddyEntry with the type of each field recorded, since
+// JSON can't tell a float that happens to be whole, such as a frag index of
+// -1, from an integer. Writing either with the other type would be rejected
+// by InfluxDB as a field type conflict.
+type spooledEntry struct {
+	Pages       map[string]spooledField
+	Node        string
+	Zone        string
+	Orders      []int64
+	Measurement string            `json:",omitempty"`
+	Tags        map[string]string `json:",omitempty"`
+}
+
+// spooledField is a field value and its type: i for int64, f for float64,
+// s for string or b for bool.
+type spooledField struct {
+	Type  string      `json:"t"`
+	Value interface{} `json:"v"`
+}
+
+func toSpooled(batch []BuddyEntry) ([]spooledEntry, error) {
+	out := make([]spooledEntry, 0, len(batch))
+	for _, entry := range batch {
+		se := spooledEntry{
+			Pages:       make(map[string]spooledField, len(entry.Pages)),
+			Node:        entry.Node,
+			Zone:        entry.Zone,
+			Orders:      entry.Orders,
+			Measurement: entry.Measurement,
+			Tags:        entry.Tags,
+		}
+		for name, value := range entry.Pages {
+			var typ string
+			switch value.(type) {
+			case int64:
+				typ = "i"
+			case float64:
+				typ = "f"
+			case string:
+				typ = "s"
+			case bool:
+				typ = "b"
+			default:
+				return nil, fmt.Errorf("can't spool field %s of type %T", name, value)
+			}
+			se.Pages[name] = spooledField{Type: typ, Value: value}
+		}
+		out = append(out, se)
+	}
+	return out, nil
+}
+
+func fromSpooled(entries []spooledEntry) []BuddyEntry {
+	batch := make([]BuddyEntry, 0, len(entries))
+	for _, se := range entries {
+		entry := BuddyEntry{
+			Pages:       make(map[string]interface{}, len(se.Pages)),
+			Node:        se.Node,
+			Zone:        se.Zone,
+			Orders:      se.Orders,
+			Measurement: se.Measurement,
+			Tags:        se.Tags,
+		}
+		for name, f := range se.Pages {
+			entry.Pages[name] = f.Value
+		}
+		batch = append(batch, entry)
+	}
+	return batch
+}
+
+// UnmarshalJSON restores the value with its recorded type.
+func (f *spooledField) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Type  string          `json:"t"`
+		Value json.RawMessage `json:"v"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	f.Type = raw.Type
+	switch raw.Type {
+	case "i":
+		var i int64
+		if err := json.Unmarshal(raw.Value, &i); err != nil {
+			return err
+		}
+		f.Value = i
+	case "f":
+		var v float64
+		if err := json.Unmarshal(raw.Value, &v); err != nil {
+			return err
+		}
+		f.Value = v
+	case "s":
+		var v string
+		if err := json.Unmarshal(raw.Value, &v); err != nil {
+			return err
+		}
+		f.Value = v
+	case "b":
+		var v bool
+		if err := json.Unmarshal(raw.Value, &v); err != nil {
+			return err
+		}
+		f.Value = v
+	default:
+		return fmt.Errorf("unknown field type %q", raw.Type)
+	}
+	return nil
+}
+
+// spoolBatch saves a batch and its timestamp to the spool directory, then
+// trims the spool to influx.SpoolMaxBytes by dropping the oldest batches.
+// File names sort in the order the batches were taken.
+func spoolBatch(influx InfluxSettings, batch []BuddyEntry, t time.Time) error {
+	if err := os.MkdirAll(influx.SpoolDir, 0755); err != nil {
+		return err
+	}
+	entries, err := toSpooled(batch)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(spooledBatch{Time: t, Batch: entries})
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary name first so a partial file is never replayed.
+	name := filepath.Join(influx.SpoolDir, fmt.Sprintf("%020d%s", t.UnixNano(), spoolSuffix))
+	if err := ioutil.WriteFile(name+".tmp", data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		return err
+	}
+	return trimSpool(influx)
+}
+
+// replaySpool writes spooled batches oldest first, removing each once it has
+// been written. It stops at the first failed write and returns its error.
+func replaySpool(ctx context.Context, conns influxConns, influx InfluxSettings) error {
+	files, err := spoolFiles(influx.SpoolDir)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		name := filepath.Join(influx.SpoolDir, f.Name())
+		batch, t, err := readSpooledBatch(name)
+		if err != nil {
+			// Nothing can be done with a corrupt file, so don't let it
+			// block the rest of the spool.
+			logger.Errorf("dropping unreadable spool file: %v", err)
+			os.Remove(name)
+			continue
+		}
+		if err := writeAll(ctx, conns, batch, t); err != nil {
+			return err
+		}
+		if err := os.Remove(name); err != nil {
+			return err
+		}
+		logger.Infof("Replayed spooled batch from %v", t)
+	}
+	return nil
+}
+
+// readSpooledBatch reads a spooled batch and the time it was taken.
+func readSpooledBatch(name string) ([]BuddyEntry, time.Time, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var sb spooledBatch
+	if err := json.Unmarshal(data, &sb); err != nil {
+		return nil, time.Time{}, fmt.Errorf("%s: %v", name, err)
+	}
+	return fromSpooled(sb.Batch), sb.Time, nil
+}
+
+// trimSpool removes the oldest spooled batches until the spool fits in
+// influx.SpoolMaxBytes. A limit of zero or less means unlimited.
+func trimSpool(influx InfluxSettings) error {
+	if influx.SpoolMaxBytes <= 0 {
+		return nil
+	}
+	files, err := spoolFiles(influx.SpoolDir)
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	for _, f := range files {
+		total += f.Size()
+	}
+	for _, f := range files {
+		if total <= influx.SpoolMaxBytes {
+			break
+		}
+		if err := os.Remove(filepath.Join(influx.SpoolDir, f.Name())); err != nil {
+			return err
+		}
+		logger.Warnf("Spool full, dropped oldest batch %s", f.Name())
+		total -= f.Size()
+	}
+	return nil
+}
+
+// spoolFiles lists spooled batches, oldest first.
+func spoolFiles(dir string) ([]os.FileInfo, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var files []os.FileInfo
+	for _, fi := range infos {
+		if fi.Mode().IsRegular() && strings.HasSuffix(fi.Name(), spoolSuffix) {
+			files = append(files, fi)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+	return files, nil
+}
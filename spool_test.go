@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSpoolKeepsFieldTypes(t *testing.T) {
+	influx := testSettings()
+	influx.SpoolDir = t.TempDir()
+	batch := []BuddyEntry{{
+		Node: "0",
+		Zone: "Normal",
+		Pages: map[string]interface{}{
+			"1p":                 int64(100),
+			"free_bytes":         int64(409600),
+			"frag_index_order_3": float64(-1),
+			"raw":                "Node 0, zone Normal 100",
+			"flag":               true,
+		},
+		Orders: []int64{100, 0, 3},
+	}, {
+		// Companion collectors' entries keep their own measurement and tags.
+		Node:        "0",
+		Zone:        "Normal",
+		Pages:       map[string]interface{}{"free": int64(23821), "min": int64(11253)},
+		Measurement: "zoneinfo",
+	}, {
+		Node:        "0",
+		Zone:        "Normal",
+		Pages:       map[string]interface{}{"1p": int64(5), "2p": int64(2)},
+		Measurement: "pagetypeinfo",
+		Tags:        map[string]string{"migratetype": "Movable"},
+	}}
+	taken := time.Unix(1500000000, 123456789)
+	if err := spoolBatch(influx, batch, taken); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := spoolFiles(influx.SpoolDir)
+	if err != nil || len(files) != 1 {
+		t.Fatalf("spoolFiles = %v, %v, want 1 file", files, err)
+	}
+	got, gotTime, err := readSpooledBatch(filepath.Join(influx.SpoolDir, files[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !gotTime.Equal(taken) {
+		t.Errorf("time = %v, want %v", gotTime, taken)
+	}
+	if !reflect.DeepEqual(got, batch) {
+		t.Errorf("read back %#v, want %#v", got, batch)
+	}
+}
+
+func TestSpoolSpillAndReplay(t *testing.T) {
+	server := newFakeInflux(t)
+	influx := server.settings(testSettings())
+	influx.SpoolDir = t.TempDir()
+	conns := newInfluxConns(influx)
+	defer conns.Close()
+
+	batchOf := func(count int64) []BuddyEntry {
+		return []BuddyEntry{{
+			Node:  "0",
+			Zone:  "Normal",
+			Pages: map[string]interface{}{"1p": count, "frag_index_order_3": float64(-1)},
+		}}
+	}
+
+	// While InfluxDB is down, each batch is spilled to the spool.
+	server.setFail(failAll)
+	for i := int64(1); i <= 2; i++ {
+		if _, err := updateInflux(context.Background(), conns, influx, batchOf(i), time.Unix(i, 0)); err == nil {
+			t.Fatalf("write %d succeeded with the server down", i)
+		}
+	}
+	if files, _ := spoolFiles(influx.SpoolDir); len(files) != 2 {
+		t.Fatalf("spooled %d batches, want 2", len(files))
+	}
+
+	// Once it's back, the spool drains oldest first, then the new batch is
+	// written, each with the time it was taken.
+	server.setFail(nil)
+	n, err := updateInflux(context.Background(), conns, influx, batchOf(3), time.Unix(3, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("updateInflux returned %d points, want 1", n)
+	}
+	lines := server.lines()
+	if len(lines) != 3 {
+		t.Fatalf("wrote %q, want 3 lines", lines)
+	}
+	for i, line := range lines {
+		if want := "1p=" + strconv.Itoa(i+1) + "i"; !strings.Contains(line, want) {
+			t.Errorf("line %d = %q, want %s", i, line, want)
+		}
+		want := strconv.FormatInt(time.Unix(int64(i+1), 0).UnixNano(), 10)
+		if !strings.HasSuffix(line, " "+want) {
+			t.Errorf("line %d = %q, want time %s", i, line, want)
+		}
+		if !strings.Contains(line, "frag_index_order_3=-1 ") && !strings.Contains(line, "frag_index_order_3=-1,") {
+			t.Errorf("line %d = %q, want frag_index_order_3 written as a float", i, line)
+		}
+	}
+	if files, _ := spoolFiles(influx.SpoolDir); len(files) != 0 {
+		t.Errorf("%d batches left in the spool after replay", len(files))
+	}
+}
+
+func TestSpoolMaxBytesDropsOldest(t *testing.T) {
+	influx := testSettings()
+	influx.SpoolDir = t.TempDir()
+	batch := []BuddyEntry{{Node: "0", Zone: "Normal", Pages: map[string]interface{}{"1p": int64(1)}}}
+	for i := int64(1); i <= 3; i++ {
+		if err := spoolBatch(influx, batch, time.Unix(i, 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, _ := spoolFiles(influx.SpoolDir)
+	if len(files) != 3 {
+		t.Fatalf("spooled %d batches, want 3", len(files))
+	}
+
+	// Room for the two newest batches only.
+	influx.SpoolMaxBytes = files[1].Size() + files[2].Size()
+	if err := trimSpool(influx); err != nil {
+		t.Fatal(err)
+	}
+	left, _ := spoolFiles(influx.SpoolDir)
+	if len(left) != 2 || left[0].Name() != files[1].Name() || left[1].Name() != files[2].Name() {
+		var names []string
+		for _, f := range left {
+			names = append(names, f.Name())
+		}
+		t.Errorf("spool holds %v, want the two newest of %s, %s, %s",
+			names, files[0].Name(), files[1].Name(), files[2].Name())
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchFile polls whenever the buddyinfo file is written or replaced, instead
+// of on an interval, until ctx is cancelled. It returns an error straight
+// away if the file can't be watched. Files in /proc never send change
+// notifications, so this is for snapshot files written by something else.
+func watchFile(ctx context.Context, conns influxConns, path string) error {
+	path = filepath.Clean(path)
+	if strings.HasPrefix(path, "/proc/") {
+		return fmt.Errorf("files in /proc don't send change notifications")
+	}
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	// Watch the directory, so the file is still seen if it is replaced
+	// rather than rewritten in place.
+	if err := w.Add(filepath.Dir(path)); err != nil {
+		return err
+	}
+	logger.Infof("Watching %s for changes", path)
+	cycleHealth.setWatching(true)
+	defer cycleHealth.setWatching(false)
+
+	poll(ctx, conns)
+	for {
+		select {
+		case ev := <-w.Events:
+			if filepath.Clean(ev.Name) == path && ev.Op&(fsnotify.Write|fsnotify.Create) != 0 {
+				poll(ctx, conns)
+			}
+		case err := <-w.Errors:
+			logger.Warnf("watching %s: %v", path, err)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
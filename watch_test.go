@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "buddyinfo")
+	if err := ioutil.WriteFile(path, []byte("Node 0, zone Normal 5 2 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	server := newFakeInflux(t)
+	influx := server.settings(testSettings())
+	influx.Path = path
+	useConfig(t, influx)
+	conns := newInfluxConns(influx)
+	defer conns.Close()
+	cycleHealth = healthStatus{}
+
+	// waitFor waits for the nth write, or fails after a few seconds.
+	waitFor := func(n int) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for len(server.writes()) < n {
+			if time.Now().After(deadline) {
+				t.Fatalf("%d writes after 5s, want %d", len(server.writes()), n)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- watchFile(ctx, conns, path) }()
+
+	// It polls once on starting, then each time the file changes.
+	waitFor(1)
+	if _, watching, _ := cycleHealth.get(); !watching {
+		t.Error("health doesn't know the file is being watched")
+	}
+	if err := ioutil.WriteFile(path, []byte("Node 0, zone Normal 6 2 1 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(2)
+
+	// Other files in the directory are ignored.
+	if err := ioutil.WriteFile(filepath.Join(dir, "other"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if n := len(server.writes()); n != 2 {
+		t.Errorf("%d writes after changing another file, want 2", n)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("watchFile returned %v after cancel, want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watchFile didn't return after cancel")
+	}
+	if _, watching, _ := cycleHealth.get(); watching {
+		t.Error("health still thinks the file is watched")
+	}
+	if lines := server.lines(); len(lines) != 2 || lines[1] == lines[0] {
+		t.Errorf("wrote %q, want the file before and after the change", lines)
+	}
+
+	if err := watchFile(context.Background(), conns, "/proc/buddyinfo"); err == nil {
+		t.Error("watching /proc/buddyinfo succeeded, want an error")
+	}
+}
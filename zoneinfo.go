@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const defaultZoneinfoPath = "/proc/zoneinfo"
+
+/*
+Zoneinfo sample, trimmed. Each zone starts with a "Node N, zone NAME" header,
+like buddyinfo, followed by its watermarks and counters.
+
+> cat /proc/zoneinfo
+Node 0, zone   Normal
+  pages free     23821
+        min      11253
+        low      14066
+        high     16879
+        spanned  3407872
+        ...
+      nr_free_pages 23821
+        ...
+*/
+
+// parseZoneInfo reads the free page count and min/low/high watermarks of each
+// zone in a zoneinfo file. The entries carry the given measurement name and
+// the same node and zone as the matching buddyinfo entries.
+func parseZoneInfo(path, measurement string, influx InfluxSettings) ([]BuddyEntry, error) {
+	lines, err := slurpLines(path, influx)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []BuddyEntry
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) >= 4 && fields[0] == "Node" && fields[2] == "zone" {
+			entries = append(entries, BuddyEntry{
+				Node:        strings.TrimSuffix(fields[1], ","),
+				Zone:        fields[3],
+				Pages:       make(map[string]interface{}),
+				Measurement: measurement,
+			})
+			continue
+		}
+		if len(entries) == 0 {
+			continue
+		}
+		cur := entries[len(entries)-1]
+
+		var name, value string
+		switch {
+		case len(fields) == 2 && (fields[0] == "nr_free_pages" || fields[0] == "min" ||
+			fields[0] == "low" || fields[0] == "high"):
+			name, value = fields[0], fields[1]
+		case len(fields) == 3 && fields[0] == "pages" && fields[1] == "free":
+			// Older kernels only report free pages here.
+			name, value = "nr_free_pages", fields[2]
+		default:
+			continue
+		}
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s value %q in %v", name, value, line)
+		}
+		cur.Pages[name] = i
+	}
+
+	// Apply the same node and zone filters as buddyinfo.
+	var filtered []BuddyEntry
+	for _, entry := range entries {
+		if len(entry.Pages) == 0 {
+			continue
+		}
+		if !allowed(influx.Nodes, entry.Node) || !zoneAllowed(influx, entry.Zone) {
+			continue
+		}
+		filtered = append(filtered, entry)
+	}
+	return filtered, nil
+}